@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+const agentJarRefreshTimeout = time.Minute * 2
+
+func agentJarRefreshEnabled() bool {
+	return *agentJarRefreshCommand != "" || *agentJarMetadataKey != ""
+}
+
+// refreshAgentJar gets a box whose agent keeps failing to connect to fetch
+// the agent.jar of the controller again, typically after a Jenkins upgrade
+// changed the remoting version, by running agentJarRefreshCommand and by
+// setting agentJarMetadataKey for a script watching it on the box.
+func refreshAgentJar(buildBox string) {
+	jarUrl := jenkinsUrl(jenkinsPath("jnlpJars", "agent.jar"))
+	log.Printf("Agent of %s keeps failing to connect, refreshing its agent.jar\n", buildBox)
+
+	if *agentJarRefreshCommand != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), agentJarRefreshTimeout)
+		defer cancel()
+		command := strings.Replace(expandBoxPlaceholders(*agentJarRefreshCommand, buildBox), "{jar}", jarUrl, -1)
+		cmd := exec.CommandContext(ctx, "sh", "-c", command)
+		cmd.Env = append(os.Environ(), "BOX="+buildBox, "INSTANCE="+instanceName(buildBox), "ZONE="+instanceZone(buildBox), "AGENT_JAR_URL="+jarUrl)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("Error refreshing the agent.jar of %s: %s: %s\n", buildBox, err.Error(), strings.TrimSpace(string(output)))
+		}
+	}
+
+	if *agentJarMetadataKey != "" {
+		if err := setInstanceMetadata(buildBox, *agentJarMetadataKey, fmt.Sprintf("%s %d", jarUrl, time.Now().Unix())); err != nil {
+			log.Printf("Error setting %s on %s: %s\n", *agentJarMetadataKey, buildBox, err.Error())
+		}
+	}
+}
+
+// setInstanceMetadata sets one metadata key of the instance of a box,
+// keeping the others.
+func setInstanceMetadata(buildBox string, key string, value string) error {
+	if isThrottled("get", buildBox) || isThrottled("set_metadata", buildBox) {
+		return errThrottled
+	}
+	i, err := service.Instances.Get(*gceProjectName, instanceZone(buildBox), instanceName(buildBox)).Do()
+	recordOperationResult("get", buildBox, err)
+	if err != nil {
+		return err
+	}
+
+	metadata := i.Metadata
+	if metadata == nil {
+		metadata = &compute.Metadata{}
+	}
+	found := false
+	for _, item := range metadata.Items {
+		if item.Key == key {
+			item.Value = &value
+			found = true
+		}
+	}
+	if !found {
+		metadata.Items = append(metadata.Items, &compute.MetadataItems{Key: key, Value: &value})
+	}
+
+	_, err = service.Instances.SetMetadata(*gceProjectName, instanceZone(buildBox), instanceName(buildBox), metadata).Do()
+	recordOperationResult("set_metadata", buildBox, err)
+	return err
+}
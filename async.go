@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// pendingStartTimeout is how long a start operation is tracked before the
+// box is given up on and becomes available again.
+const pendingStartTimeout = time.Minute * 10
+
+// pendingStart tracks a box whose start operation has been issued but is not
+// online in Jenkins yet.
+type pendingStart struct {
+	operation string
+	since     time.Time
+	launching bool
+}
+
+var pendingStarts = struct {
+	sync.Mutex
+	m map[string]*pendingStart
+}{m: make(map[string]*pendingStart)}
+
+func isPendingStart(buildBox string) bool {
+	pendingStarts.Lock()
+	defer pendingStarts.Unlock()
+	_, ok := pendingStarts.m[buildBox]
+	return ok
+}
+
+func countPendingStarts() int {
+	pendingStarts.Lock()
+	defer pendingStarts.Unlock()
+	return len(pendingStarts.m)
+}
+
+// beginStart issues the start, or resume, of a box without waiting for it to
+// complete; progressPendingStarts picks it up in the following iterations.
+func beginStart(buildBox string) bool {
+	if isThrottled("start", buildBox) {
+		log.Printf("Not starting %s while GCE is throttling us\n", buildBox)
+		return false
+	}
+	if !*powerOnly && !isNodeTemporarilyOffline(buildBox) {
+		toggleNodeStatus(buildBox, "offline")
+	}
+	announceProvisioning(buildBox)
+
+	status, err := cloudBoxStatus(buildBox)
+	if err != nil {
+		log.Printf("Failed to get instance data: %v\n", err)
+		return false
+	}
+
+	if status != "RUNNING" {
+		if err := ensureDependenciesRunning(); err != nil {
+			log.Printf("Not starting %s, its dependencies failed to start: %s\n", buildBox, err.Error())
+			notifyKind(eventFailure, "dependencies", buildBox, fmt.Sprintf("Dependencies of %s failed to start: %s", buildBox, err.Error()))
+			return false
+		}
+	}
+
+	pending := &pendingStart{since: time.Now()}
+	switch status {
+	case "RUNNING":
+		pending.launching = true
+	case "SUSPENDED":
+		op, err := service.Instances.Resume(*gceProjectName, instanceZone(buildBox), instanceName(buildBox)).Do()
+		recordOperationResult("start", buildBox, err)
+		if err != nil {
+			log.Println(err)
+			notifyKind(eventFailure, "start", buildBox, fmt.Sprintf("Failed to start %s: %s", buildBox, err.Error()))
+			return false
+		}
+		pending.operation = op.Name
+	case "TERMINATED":
+		op, err := service.Instances.Start(*gceProjectName, instanceZone(buildBox), instanceName(buildBox)).Do()
+		recordOperationResult("start", buildBox, err)
+		if err != nil {
+			log.Println(err)
+			notifyKind(eventFailure, "start", buildBox, fmt.Sprintf("Failed to start %s: %s", buildBox, err.Error()))
+			return false
+		}
+		pending.operation = op.Name
+	default:
+		log.Printf("%s is %s, waiting for it to settle before starting it\n", buildBox, status)
+		return false
+	}
+
+	log.Printf("Start of %s issued\n", buildBox)
+	pendingStarts.Lock()
+	pendingStarts.m[buildBox] = pending
+	pendingStarts.Unlock()
+	if pending.launching {
+		go completeStart(buildBox)
+	}
+	return true
+}
+
+// progressPendingStarts checks the start operations issued in previous
+// iterations, launching the agent of the boxes that are now running.
+func progressPendingStarts() {
+	pendingStarts.Lock()
+	issued := map[string]pendingStart{}
+	for buildBox, pending := range pendingStarts.m {
+		if !pending.launching {
+			issued[buildBox] = *pending
+		}
+	}
+	pendingStarts.Unlock()
+
+	var ready, failed []string
+	for buildBox, pending := range issued {
+		if time.Since(pending.since) > pendingStartTimeout {
+			log.Printf("Start of %s still not done after %s, giving up\n", buildBox, pendingStartTimeout)
+			failed = append(failed, buildBox)
+			continue
+		}
+
+		op, err := service.ZoneOperations.Get(*gceProjectName, instanceZone(buildBox), pending.operation).Do()
+		if err != nil {
+			log.Printf("Failed to get start operation of %s: %v\n", buildBox, err)
+			continue
+		}
+		if op.Status != "DONE" {
+			continue
+		}
+		if op.Error != nil && len(op.Error.Errors) > 0 {
+			log.Printf("Start of %s failed: %s\n", buildBox, op.Error.Errors[0].Message)
+			failed = append(failed, buildBox)
+			continue
+		}
+		ready = append(ready, buildBox)
+	}
+
+	pendingStarts.Lock()
+	for _, buildBox := range failed {
+		delete(pendingStarts.m, buildBox)
+	}
+	for _, buildBox := range ready {
+		if pending, ok := pendingStarts.m[buildBox]; ok {
+			pending.launching = true
+		}
+	}
+	pendingStarts.Unlock()
+
+	for _, buildBox := range failed {
+		notifyKind(eventFailure, "start", buildBox, fmt.Sprintf("Failed to start %s", buildBox))
+	}
+	for _, buildBox := range ready {
+		invalidateNodeInfo(buildBox)
+		lastStarted.Lock()
+		lastStarted.m[buildBox] = time.Now()
+		lastStarted.Unlock()
+		markStarted(buildBox)
+		notify(eventScaleUp, buildBox, fmt.Sprintf("Started %s", buildBox))
+		go completeStart(buildBox)
+	}
+}
+
+// completeStart brings a running box online in Jenkins, in the background
+// so the iterations carry on meanwhile.
+func completeStart(buildBox string) {
+	defer recoverWorker()
+	pendingStarts.Lock()
+	since := pendingStarts.m[buildBox].since
+	pendingStarts.Unlock()
+	defer func() {
+		pendingStarts.Lock()
+		delete(pendingStarts.m, buildBox)
+		pendingStarts.Unlock()
+	}()
+
+	if *powerOnly {
+		return
+	}
+	agentLaunched := true
+	if !isAgentConnected(buildBox) {
+		agentLaunched = launchNodeAgent(buildBox)
+	}
+	if agentLaunched && isNodeTemporarilyOffline(buildBox) {
+		toggleNodeStatus(buildBox, "online")
+	}
+	if agentLaunched {
+		recordBootLeadTime(time.Since(since))
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	roleRead    = "read"
+	roleOperate = "operate"
+)
+
+type roleKey struct{}
+
+// apiAuth holds what callers of the HTTP API are authenticated against:
+// static bearer tokens, client certificates and Google identity tokens,
+// the last two mapped to roles by identity.
+var apiAuth = struct {
+	tokens     map[string]string
+	identities map[string]string
+	clientCAs  *x509.CertPool
+}{tokens: make(map[string]string), identities: make(map[string]string)}
+
+// identityTokens caches the identity tokens checked against tokeninfo, the
+// rejected ones with an empty email for rejectedTokenTtl, so a caller
+// retrying a bad token does not get a request sent to Google every time.
+var identityTokens = struct {
+	sync.Mutex
+	m map[string]verifiedIdentity
+}{m: make(map[string]verifiedIdentity)}
+
+const rejectedTokenTtl = time.Minute
+
+type verifiedIdentity struct {
+	email   string
+	expires time.Time
+}
+
+func setupApiAuth() error {
+	for role, value := range map[string]string{roleRead: *apiReadTokens, roleOperate: *apiOperateTokens} {
+		for _, token := range splitList(value) {
+			apiAuth.tokens[token] = role
+		}
+	}
+	for role, value := range map[string]string{roleRead: *apiReadIdentities, roleOperate: *apiOperateIdentities} {
+		for _, identity := range splitList(value) {
+			apiAuth.identities[identity] = role
+		}
+	}
+
+	if (*apiTlsCert == "") != (*apiTlsKey == "") {
+		return errors.New("apiTlsCert and apiTlsKey should be set together")
+	}
+	if *apiClientCa != "" {
+		if *apiTlsCert == "" {
+			return errors.New("apiClientCa requires apiTlsCert and apiTlsKey")
+		}
+		content, err := ioutil.ReadFile(*apiClientCa)
+		if err != nil {
+			return err
+		}
+		apiAuth.clientCAs = x509.NewCertPool()
+		if !apiAuth.clientCAs.AppendCertsFromPEM(content) {
+			return errors.New("no certificate found in " + *apiClientCa)
+		}
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func apiAuthEnabled() bool {
+	return len(apiAuth.tokens) > 0 || apiAuth.clientCAs != nil || *apiGoogleAudience != ""
+}
+
+// apiTlsConfig asks for client certificates, without requiring them so
+// token based callers can still connect.
+func apiTlsConfig() *tls.Config {
+	if apiAuth.clientCAs == nil {
+		return nil
+	}
+	return &tls.Config{ClientCAs: apiAuth.clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+}
+
+// authenticate rejects callers with no role when authentication is
+// configured, and passes the caller role on to requireRole.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiAuthEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		role := callerRole(r)
+		if role == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleKey{}, role)))
+	})
+}
+
+// requireRole restricts a route to the operate role. Operating routes are
+// never open: they are refused altogether when no authentication is
+// configured.
+func requireRole(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasRole(r, role) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// hasRole tells whether the caller of a request authenticated with a role,
+// anyone having the read role when no authentication is configured.
+func hasRole(r *http.Request, role string) bool {
+	caller, _ := r.Context().Value(roleKey{}).(string)
+	return role == roleRead || caller == roleOperate
+}
+
+func callerRole(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if role, ok := apiAuth.identities[r.TLS.VerifiedChains[0][0].Subject.CommonName]; ok {
+			return role
+		}
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return ""
+	}
+	for known, role := range apiAuth.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return role
+		}
+	}
+	if *apiGoogleAudience != "" && looksLikeJwt(token) {
+		if email, ok := verifyIdentityToken(token); ok {
+			return apiAuth.identities[email]
+		}
+	}
+	return ""
+}
+
+// looksLikeJwt tells whether a token has the three dot separated base64url
+// parts of a JWT, the only tokens worth sending to tokeninfo.
+func looksLikeJwt(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], "eyJ") {
+		return false
+	}
+	for _, part := range parts {
+		if part == "" || strings.Trim(part, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyIdentityToken checks a Google signed identity token against the
+// tokeninfo endpoint, caching the answer until the token expires, or for
+// rejectedTokenTtl when it is rejected.
+func verifyIdentityToken(token string) (string, bool) {
+	identityTokens.Lock()
+	verified, ok := identityTokens.m[token]
+	identityTokens.Unlock()
+	if ok && time.Now().Before(verified.expires) {
+		return verified.email, verified.email != ""
+	}
+
+	email, expires, err := checkTokenInfo(token)
+	if err != nil {
+		return "", false
+	}
+	if email == "" {
+		expires = time.Now().Add(rejectedTokenTtl)
+	}
+
+	identityTokens.Lock()
+	for t, v := range identityTokens.m {
+		if time.Now().After(v.expires) {
+			delete(identityTokens.m, t)
+		}
+	}
+	identityTokens.m[token] = verifiedIdentity{email: email, expires: expires}
+	identityTokens.Unlock()
+	return email, email != ""
+}
+
+// checkTokenInfo returns the email and expiry of a valid identity token for
+// apiGoogleAudience, an empty email when tokeninfo rejects it, or an error
+// when tokeninfo could not be reached.
+func checkTokenInfo(token string) (string, time.Time, error) {
+	resp, err := outboundClient.Get("https://oauth2.googleapis.com/tokeninfo?id_token=" + url.QueryEscape(token))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return "", time.Time{}, errors.New("tokeninfo answered with status " + strconv.Itoa(resp.StatusCode))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, nil
+	}
+
+	var info struct {
+		Audience      string `json:"aud"`
+		Email         string `json:"email"`
+		EmailVerified string `json:"email_verified"`
+		Expires       string `json:"exp"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", time.Time{}, nil
+	}
+	expires, err := strconv.ParseInt(info.Expires, 10, 64)
+	if err != nil || info.Audience != *apiGoogleAudience || info.EmailVerified != "true" || time.Now().Unix() > expires {
+		return "", time.Time{}, nil
+	}
+	return info.Email, time.Unix(expires, 0), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const minThrottlingDelay = time.Second * 30
+const maxThrottlingDelay = time.Minute * 10
+
+var errThrottled = errors.New("operation throttled by GCE, backing off")
+
+var gceBackoff = struct {
+	sync.Mutex
+	m map[string]*backoffState
+}{m: make(map[string]*backoffState)}
+
+type backoffState struct {
+	delay time.Duration
+	until time.Time
+}
+
+// isThrottled tells whether the operation on the given box is still within
+// the backoff window opened by a previous rate limit or quota error.
+func isThrottled(operation string, buildBox string) bool {
+	gceBackoff.Lock()
+	defer gceBackoff.Unlock()
+
+	state := gceBackoff.m[operation+"/"+buildBox]
+	return state != nil && state.until.After(time.Now())
+}
+
+// recordOperationResult doubles the backoff of an operation every time GCE
+// throttles it and resets it as soon as a call goes through.
+func recordOperationResult(operation string, buildBox string, err error) {
+	key := operation + "/" + buildBox
+
+	gceBackoff.Lock()
+	defer gceBackoff.Unlock()
+
+	if !isThrottlingError(err) {
+		if _, ok := gceBackoff.m[key]; ok {
+			delete(gceBackoff.m, key)
+			throttledOperations.Set(key, new(expvar.Int))
+		}
+		return
+	}
+
+	state := gceBackoff.m[key]
+	if state == nil {
+		state = &backoffState{delay: minThrottlingDelay}
+		gceBackoff.m[key] = state
+	} else if state.delay < maxThrottlingDelay {
+		state.delay = state.delay * 2
+		if state.delay > maxThrottlingDelay {
+			state.delay = maxThrottlingDelay
+		}
+	}
+	state.until = time.Now().Add(state.delay)
+
+	throttledOperations.Add(key, 1)
+	throttledTotal.Add(1)
+	log.Printf("GCE throttled %s on %s, backing off for %s\n", operation, buildBox, state.delay)
+}
+
+func isThrottlingError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == 429 {
+		return true
+	}
+	for _, item := range apiErr.Errors {
+		switch item.Reason {
+		case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded":
+			return true
+		}
+	}
+	return false
+}
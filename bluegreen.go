@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	colourBlue  = "blue"
+	colourGreen = "green"
+)
+
+// switchState is the colour the pool is switching to, and since when. It is
+// kept in stateFile.
+type switchState struct {
+	Target string    `json:"target"`
+	Since  time.Time `json:"since"`
+}
+
+var poolSwitch = struct {
+	sync.Mutex
+	state switchState
+}{state: switchState{Target: colourBlue}}
+
+var greenBoxes = map[string]bool{}
+
+// loadGreenBoxes adds the green boxes to the pool.
+func loadGreenBoxes() {
+	for _, buildBox := range splitList(*greenBoxesFlag) {
+		greenBoxes[buildBox] = true
+		if !inPool(buildBox) {
+			buildBoxesPool = append(buildBoxesPool, buildBox)
+		}
+	}
+}
+
+func colour(buildBox string) string {
+	if greenBoxes[buildBox] {
+		return colourGreen
+	}
+	return colourBlue
+}
+
+func currentSwitch() switchState {
+	poolSwitch.Lock()
+	defer poolSwitch.Unlock()
+	return poolSwitch.state
+}
+
+// isRetired tells whether a box belongs to the colour the pool switched away
+// from more than switchDuration ago, which takes it out of rotation.
+func isRetired(buildBox string) bool {
+	if len(greenBoxes) == 0 {
+		return false
+	}
+	state := currentSwitch()
+	return colour(buildBox) != state.Target && time.Since(state.Since) >= *switchDuration
+}
+
+// targetColourFirst moves the boxes of the colour the pool is switching to
+// ahead of the others, keeping the current order otherwise.
+func targetColourFirst(buildBoxes []string) []string {
+	if len(greenBoxes) == 0 {
+		return buildBoxes
+	}
+	target := currentSwitch().Target
+	sorted := append([]string{}, buildBoxes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return colour(sorted[i]) == target && colour(sorted[j]) != target
+	})
+	return sorted
+}
+
+// targetColourLast is the order boxes are stopped in during a switch.
+func targetColourLast(buildBoxes []string) []string {
+	if len(greenBoxes) == 0 {
+		return buildBoxes
+	}
+	target := currentSwitch().Target
+	sorted := append([]string{}, buildBoxes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return colour(sorted[i]) != target && colour(sorted[j]) == target
+	})
+	return sorted
+}
+
+// stopRetiredBoxes stops the retired boxes as soon as they are idle, even
+// while jobs are waiting for the other colour.
+func stopRetiredBoxes() {
+	if len(greenBoxes) == 0 || observerBuild {
+		return
+	}
+	for _, buildBox := range buildBoxesPool {
+		if isRetired(buildBox) && isCloudBoxRunning(buildBox) && isNodeIdle(buildBox) {
+			log.Printf("%s is %s while the pool switched to %s, stopping it\n", buildBox, colour(buildBox), currentSwitch().Target)
+			disableNode(buildBox)
+		}
+	}
+}
+
+func switchPool(target string) {
+	poolSwitch.Lock()
+	if poolSwitch.state.Target == target {
+		poolSwitch.Unlock()
+		return
+	}
+	poolSwitch.state = switchState{Target: target, Since: time.Now()}
+	poolSwitch.Unlock()
+	saveStateNow()
+
+	log.Printf("Switching the pool to %s\n", target)
+	notify(eventSwitch, "", "Switching pool "+*poolName+" to "+target)
+}
+
+// serveSwitch returns the switch state, and switches the pool to the colour
+// given with ?to= on POST, which requires the operate role and is refused
+// by observer builds.
+func serveSwitch(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !hasRole(r, roleOperate) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if observerBuild {
+			http.Error(w, errObserver.Error(), http.StatusConflict)
+			return
+		}
+		target := r.URL.Query().Get("to")
+		if target != colourBlue && target != colourGreen {
+			http.Error(w, "to should be either blue or green", http.StatusBadRequest)
+			return
+		}
+		if len(greenBoxes) == 0 {
+			http.Error(w, "no green boxes configured", http.StatusConflict)
+			return
+		}
+		switchPool(target)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentSwitch())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const busTimeout = time.Second * 10
+
+// busSinks are the sinks feeding an event bus, which get the state
+// transitions by default on top of the scaling events.
+var busSinks = map[string]bool{"nats": true, "kafka": true}
+
+// natsNotifier publishes events as JSON to a NATS subject, speaking the
+// plain text client protocol over a connection per event.
+type natsNotifier struct {
+	url     *url.URL
+	subject string
+}
+
+func (n *natsNotifier) Notify(event scalingEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", n.url.Host, busTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(busTimeout))
+
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil {
+		return err
+	} else if !strings.HasPrefix(line, "INFO") {
+		return fmt.Errorf("unexpected NATS greeting %q", strings.TrimSpace(line))
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "jenkins-nodes-auto-scaler"}
+	if n.url.User != nil {
+		options["user"] = n.url.User.Username()
+		options["pass"], _ = n.url.User.Password()
+	}
+	connect, _ := json.Marshal(options)
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "CONNECT %s\r\n", connect)
+	fmt.Fprintf(&buffer, "PUB %s %d\r\n%s\r\n", n.subject, len(payload), payload)
+	buffer.WriteString("PING\r\n")
+	if _, err := conn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+
+	// The server answers the PING once the publication is processed, or
+	// reports an error first.
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS answered %s", line)
+		}
+	}
+}
+
+// kafkaNotifier produces events as JSON records to a Kafka topic through a
+// Kafka REST proxy, keyed by pool and box so a box's events stay ordered.
+type kafkaNotifier struct {
+	restProxyUrl string
+	topic        string
+}
+
+func (k *kafkaNotifier) Notify(event scalingEvent) error {
+	type record struct {
+		Key   string       `json:"key"`
+		Value scalingEvent `json:"value"`
+	}
+	content, err := json.Marshal(struct {
+		Records []record `json:"records"`
+	}{[]record{{Key: event.Pool + "/" + event.Box, Value: event}}})
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(k.restProxyUrl, "/") + "/topics/" + url.PathEscape(k.topic)
+	resp, err := outboundClient.Post(endpoint, "application/vnd.kafka.json.v2+json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered with status %d", endpoint, resp.StatusCode)
+	}
+	return nil
+}
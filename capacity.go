@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	"google.golang.org/api/transport"
+)
+
+const capacitySchemaVersion = 1
+const storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// The document written to desiredCapacityOutput. Fields are only ever added
+// to this schema; anything else requires bumping capacitySchemaVersion.
+type capacityDocument struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	GeneratedAt   time.Time      `json:"generatedAt"`
+	Pools         []poolCapacity `json:"pools"`
+}
+
+type poolCapacity struct {
+	Name             string `json:"name"`
+	DesiredBoxes     int    `json:"desiredBoxes"`
+	DesiredExecutors int    `json:"desiredExecutors"`
+	MaxBoxes         int    `json:"maxBoxes"`
+}
+
+var lastCapacity []poolCapacity
+var storageClient *http.Client
+
+// publishDesiredCapacity writes the number of boxes the scaler wants online
+// when it changed: the online boxes plus the ones needed for the queue, or
+// the busy boxes, and the one kept online, when the queue is empty.
+func publishDesiredCapacity(queueSize int, keptOnline bool) {
+	if *desiredCapacityOutput == "" {
+		return
+	}
+
+	observedState.Lock()
+	online := 0
+	busy := 0
+	for _, buildBox := range buildBoxesPool {
+		box := observedBox(buildBox)
+		if !box.NodeOffline {
+			online++
+			if !box.NodeIdle {
+				busy++
+			}
+		}
+	}
+	boxesNeeded := observedState.demand.BoxesNeeded
+	observedState.Unlock()
+
+	desired := busy
+	if queueSize > 0 {
+		desired = online + boxesNeeded
+	} else if keptOnline && desired == 0 {
+		desired = 1
+	}
+	if desired > len(buildBoxesPool) {
+		desired = len(buildBoxesPool)
+	}
+
+	pools := []poolCapacity{{
+		Name:             *poolName,
+		DesiredBoxes:     desired,
+		DesiredExecutors: desired * *workersPerBuildBox,
+		MaxBoxes:         len(buildBoxesPool),
+	}}
+	if reflect.DeepEqual(pools, lastCapacity) {
+		return
+	}
+
+	body, _ := json.MarshalIndent(capacityDocument{
+		SchemaVersion: capacitySchemaVersion,
+		GeneratedAt:   time.Now(),
+		Pools:         pools,
+	}, "", "  ")
+	if err := writeCapacity(*desiredCapacityOutput, body); err != nil {
+		log.Printf("Error writing desired capacity to %s: %s\n", *desiredCapacityOutput, err.Error())
+		return
+	}
+	lastCapacity = pools
+}
+
+// writeCapacity writes to a gs://bucket/object destination or to a local
+// file, replacing it atomically.
+func writeCapacity(destination string, body []byte) error {
+	if strings.HasPrefix(destination, "gs://") {
+		return uploadToStorage(strings.TrimPrefix(destination, "gs://"), body)
+	}
+
+	tmp := filepath.Join(filepath.Dir(destination), "."+filepath.Base(destination)+".tmp")
+	if err := ioutil.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, destination)
+}
+
+func uploadToStorage(bucketAndObject string, body []byte) error {
+	parts := strings.SplitN(bucketAndObject, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid gs:// destination, expected gs://bucket/object")
+	}
+
+	if storageClient == nil {
+		client, err := newStorageClient()
+		if err != nil {
+			return err
+		}
+		storageClient = guardClient(client)
+	}
+
+	uploadUrl := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.PathEscape(parts[0]), url.QueryEscape(parts[1]))
+	resp, err := storageClient.Post(uploadUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("upload answered %s", resp.Status)
+	}
+	return nil
+}
+
+func newStorageClient() (*http.Client, error) {
+	ctx := context.TODO()
+	if *localCreds {
+		client, _, err := transport.NewHTTPClient(ctx, option.WithScopes(storageScope), option.WithServiceAccountFile("creds.json"))
+		return client, err
+	}
+	return google.DefaultClient(ctx, storageScope)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// minimumJenkinsVersion is the oldest version the endpoints used by the
+// scaler are known to work with.
+const minimumJenkinsVersion = "1.651"
+
+var jenkinsVersion string
+
+var jenkinsCrumb = struct {
+	sync.RWMutex
+	field string
+	value string
+}{}
+
+// launchAgentEndpoint is the endpoint used to launch agents, launchAgent on
+// recent Jenkins versions and launchSlaveAgent on older ones.
+var launchAgentEndpoint = struct {
+	sync.Mutex
+	name string
+}{name: "launchAgent"}
+
+type JenkinsCrumb struct {
+	Crumb             string `json:"crumb"`
+	CrumbRequestField string `json:"crumbRequestField"`
+}
+
+// checkJenkinsCompatibility reads the Jenkins version from the X-Jenkins
+// header, warning when it is older than the scaler supports, and fetches a
+// CSRF crumb when the server requires one.
+func checkJenkinsCompatibility() {
+	resp, err := jenkinsRequest("version", "GET", "api/json?tree=mode")
+	if err != nil {
+		log.Printf("Error checking Jenkins version: %s\n", err.Error())
+		return
+	}
+	resp.Body.Close()
+
+	jenkinsVersion = resp.Header.Get("X-Jenkins")
+	if jenkinsVersion == "" {
+		log.Println("Could not determine the Jenkins version, is the base url pointing to Jenkins?")
+	} else {
+		log.Printf("Jenkins version %s\n", jenkinsVersion)
+		if compareVersions(jenkinsVersion, minimumJenkinsVersion) < 0 {
+			log.Printf("Jenkins %s is older than %s, some calls might fail\n", jenkinsVersion, minimumJenkinsVersion)
+		}
+	}
+
+	refreshCrumb()
+}
+
+// refreshCrumb fetches a new CSRF crumb, clearing it when the crumb issuer
+// is disabled.
+func refreshCrumb() {
+	resp, err := jenkinsRequest("crumb", "GET", jenkinsPath("crumbIssuer", "api", "json"))
+	if err != nil {
+		log.Printf("Error fetching Jenkins crumb: %s\n", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	var data JenkinsCrumb
+	if resp.StatusCode == 200 {
+		if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+			log.Printf("Error deserialising Jenkins crumb: %s\n", err.Error())
+			return
+		}
+	}
+
+	jenkinsCrumb.Lock()
+	jenkinsCrumb.field = data.CrumbRequestField
+	jenkinsCrumb.value = data.Crumb
+	jenkinsCrumb.Unlock()
+}
+
+func setJenkinsCrumb(req *http.Request) {
+	if req.Method == "GET" {
+		return
+	}
+
+	jenkinsCrumb.RLock()
+	defer jenkinsCrumb.RUnlock()
+	if jenkinsCrumb.field != "" {
+		req.Header.Set(jenkinsCrumb.field, jenkinsCrumb.value)
+	}
+}
+
+// compareVersions compares dotted version numbers such as 2.289.1,
+// ignoring any suffix like -SNAPSHOT.
+func compareVersions(a string, b string) int {
+	partsA := strings.Split(strings.SplitN(a, "-", 2)[0], ".")
+	partsB := strings.Split(strings.SplitN(b, "-", 2)[0], ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var numberA, numberB int
+		if i < len(partsA) {
+			numberA, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			numberB, _ = strconv.Atoi(partsB[i])
+		}
+		if numberA != numberB {
+			if numberA < numberB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// launchAgent asks Jenkins to launch the agent of a node, switching to the
+// other launch endpoint for good when the current one does not exist. A 405
+// means the endpoint exists but refused the request, so it is kept.
+func launchAgent(buildBox string) {
+	launchAgentEndpoint.Lock()
+	endpoint := launchAgentEndpoint.name
+	launchAgentEndpoint.Unlock()
+
+	status := postLaunchAgent(buildBox, endpoint)
+	switch status {
+	case 404:
+		alternative := "launchSlaveAgent"
+		if endpoint == alternative {
+			alternative = "launchAgent"
+		}
+		if postLaunchAgent(buildBox, alternative) != 404 {
+			log.Printf("Jenkins has no %s endpoint, using %s from now on\n", endpoint, alternative)
+			launchAgentEndpoint.Lock()
+			launchAgentEndpoint.name = alternative
+			launchAgentEndpoint.Unlock()
+		}
+	case 405:
+		log.Printf("Jenkins refused the %s request for %s with status 405\n", endpoint, buildBox)
+	}
+}
+
+func postLaunchAgent(buildBox string, endpoint string) int {
+	resp, err := jenkinsRequest("launch", "POST", jenkinsPath("computer", buildBox, endpoint))
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const controlTimeout = time.Second * 30
+
+// runControlJob runs the jobs acting on a scaler already running, through
+// its HTTP API at controlUrl, and tells whether jobType was one of them.
+// They need none of the Jenkins and GCE settings.
+func runControlJob(jobType string) bool {
+	var method string
+	query := url.Values{}
+	path := ""
+	switch jobType {
+	case "override":
+		path = "/v1/override"
+		if *overrideBoxes == 0 {
+			method = "DELETE"
+			break
+		}
+		method = "POST"
+		query.Set("boxes", strconv.Itoa(*overrideBoxes))
+		query.Set("for", overrideFor.String())
+		if *overrideReason != "" {
+			query.Set("reason", *overrideReason)
+		}
+	case "switch":
+		path = "/v1/switch"
+		method = "POST"
+		query.Set("to", *switchTo)
+	default:
+		return false
+	}
+
+	if err := callControlApi(method, path, query); err != nil {
+		log.Printf("Error running %s against %s: %s\n", jobType, *controlUrl, err.Error())
+		os.Exit(1)
+	}
+	return true
+}
+
+// callControlApi sends the request with the controlToken bearer token and
+// prints the answer of the running scaler.
+func callControlApi(method string, path string, query url.Values) error {
+	if *controlUrl == "" {
+		return fmt.Errorf("controlUrl flag should not be empty")
+	}
+	u := strings.TrimSuffix(*controlUrl, "/") + path
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+	if *controlToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*controlToken)
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("answered with status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+	return nil
+}
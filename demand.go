@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"regexp"
+	"sort"
+)
+
+var unsatisfiableDemandMetric = expvar.NewInt("unsatisfiable_demand")
+
+const pipelineJobClass = "org.jenkinsci.plugins.workflow.job.WorkflowJob"
+const pipelinePlaceholderClass = "org.jenkinsci.plugins.workflow.support.steps.ExecutorStepExecution$PlaceholderTask"
+
+var pipelinePlaceholderName = regexp.MustCompile(`^part of (.+)$`)
+
+// The reasons Jenkins gives for items waiting on a specific node or label.
+var restrictedQueueItemPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^Waiting for next available executor on ‘?(.+?)’?$`),
+	regexp.MustCompile(`^‘?(.+?)’? is offline$`),
+	regexp.MustCompile(`^All nodes of label ‘?(.+?)’? are offline$`),
+}
+
+type JenkinsLabel struct {
+	Nodes []struct {
+		NodeName string `json:"nodeName"`
+	} `json:"nodes"`
+}
+
+// requestedBoxes are the pool boxes queued items are explicitly waiting for,
+// started before any other box.
+var requestedBoxes = map[string]bool{}
+var unsatisfiableDemand int
+
+// needsAgentExecutor tells whether a queue item takes an agent executor.
+// Pipeline runs themselves execute on a flyweight executor on the controller,
+// only the placeholder tasks of their node blocks ("part of <run>") need an
+// agent, and count towards demand according to pipelineNodeDemand.
+func needsAgentExecutor(item JenkinsQueueItem, pipelineRuns map[string]bool) bool {
+	if item.Task.Class == pipelineJobClass {
+		return false
+	}
+	if item.Task.Class != pipelinePlaceholderClass && !pipelinePlaceholderName.MatchString(item.Task.Name) {
+		return true
+	}
+
+	switch *pipelineNodeDemand {
+	case "ignore":
+		return false
+	case "per-run":
+		run := item.Task.Name
+		if match := pipelinePlaceholderName.FindStringSubmatch(item.Task.Name); match != nil {
+			run = match[1]
+		}
+		if pipelineRuns[run] {
+			return false
+		}
+		pipelineRuns[run] = true
+	}
+	return true
+}
+
+// restrictedTo returns the node or label a queue item is waiting for, if any.
+func restrictedTo(why string) (string, bool) {
+	for _, pattern := range restrictedQueueItemPatterns {
+		if match := pattern.FindStringSubmatch(why); match != nil {
+			return match[1], true
+		}
+	}
+	return "", false
+}
+
+// poolBoxesFor resolves a node name or label to the pool boxes able to run
+// the items waiting for it.
+func poolBoxesFor(nodeOrLabel string) []string {
+	for _, buildBox := range buildBoxesPool {
+		if buildBox == nodeOrLabel {
+			return []string{buildBox}
+		}
+	}
+
+	resp, err := jenkinsRequest("label", "GET", jenkinsPath("label", nodeOrLabel, "api", "json")+"?tree=nodes[nodeName]")
+	if err != nil {
+		log.Printf("Error fetching Jenkins label %s: %s\n", nodeOrLabel, err.Error())
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil
+	}
+
+	var data JenkinsLabel
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		log.Printf("Error deserialising Jenkins label %s: %s\n", nodeOrLabel, err.Error())
+		return nil
+	}
+
+	var buildBoxes []string
+	for _, node := range data.Nodes {
+		for _, buildBox := range buildBoxesPool {
+			if node.NodeName == buildBox {
+				buildBoxes = append(buildBoxes, buildBox)
+			}
+		}
+	}
+	return buildBoxes
+}
+
+// restrictedItem is a queue item waiting for a specific node or label.
+type restrictedItem struct {
+	nodeOrLabel string
+	item        JenkinsQueueItem
+}
+
+// resolveRestrictedItems checks the node or label of each restricted queue
+// item against the pool, returning the items the pool can serve and
+// recording which boxes they are waiting for.
+func resolveRestrictedItems(restrictions []restrictedItem) []JenkinsQueueItem {
+	resolved := map[string][]string{}
+	requested := map[string]bool{}
+	var satisfiable []JenkinsQueueItem
+	unsatisfiable := 0
+	for _, restriction := range restrictions {
+		buildBoxes, ok := resolved[restriction.nodeOrLabel]
+		if !ok {
+			buildBoxes = poolBoxesFor(restriction.nodeOrLabel)
+			resolved[restriction.nodeOrLabel] = buildBoxes
+		}
+
+		if len(buildBoxes) == 0 {
+			unsatisfiable = unsatisfiable + 1
+			continue
+		}
+		satisfiable = append(satisfiable, restriction.item)
+		for _, buildBox := range buildBoxes {
+			requested[buildBox] = true
+		}
+	}
+
+	if unsatisfiable > 0 {
+		var names []string
+		for nodeOrLabel, buildBoxes := range resolved {
+			if len(buildBoxes) == 0 {
+				names = append(names, nodeOrLabel)
+			}
+		}
+		sort.Strings(names)
+		log.Printf("%d jobs are waiting for nodes outside the pool, ignoring them: %v\n", unsatisfiable, names)
+	}
+
+	requestedBoxes = requested
+	unsatisfiableDemand = unsatisfiable
+	unsatisfiableDemandMetric.Set(int64(unsatisfiable))
+	return satisfiable
+}
+
+// requestedFirst moves the boxes queued items are waiting for to the front,
+// keeping the relative order of the others.
+func requestedFirst(buildBoxes []string) []string {
+	ordered := append([]string{}, buildBoxes...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return requestedBoxes[ordered[i]] && !requestedBoxes[ordered[j]]
+	})
+	return ordered
+}
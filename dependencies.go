@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const dependencyStartTimeout = time.Minute * 5
+
+// dependencies tracks whether the instances in dependencyInstances are known
+// to be running, and when that was last checked, so they are only checked
+// again before the first box start after the pool was idle, whether they may
+// be running, which is assumed until the scaler stops them, and whether they
+// are being started, which holds back stopping them.
+var dependencies = struct {
+	sync.Mutex
+	running  bool
+	checked  time.Time
+	mayBeUp  bool
+	starting bool
+}{mayBeUp: true}
+
+// dependencyStarts lets a single box start at a time check and start the
+// dependencies, the others waiting for it, without holding the dependencies
+// lock while the instances boot.
+var dependencyStarts sync.Mutex
+
+// ensureDependenciesRunning starts the dependency instances, in the order
+// they are listed, waiting for each to be running before the next. An
+// instance still stopping is left to stop before it is started again.
+func ensureDependenciesRunning() error {
+	instances := splitList(*dependencyInstances)
+	if len(instances) == 0 {
+		return nil
+	}
+
+	dependencyStarts.Lock()
+	defer dependencyStarts.Unlock()
+
+	dependencies.Lock()
+	if dependencies.running && (!noBoxOnline() || time.Since(dependencies.checked) < time.Minute) {
+		dependencies.Unlock()
+		return nil
+	}
+	dependencies.starting = true
+	dependencies.mayBeUp = true
+	dependencies.Unlock()
+	defer func() {
+		dependencies.Lock()
+		dependencies.starting = false
+		dependencies.Unlock()
+	}()
+
+	for _, instance := range instances {
+		if isThrottled("get", instance) {
+			return errThrottled
+		}
+		i, err := service.Instances.Get(*gceProjectName, zoneOfInstance(instance), instance).Do()
+		recordOperationResult("get", instance, err)
+		if err != nil {
+			return err
+		}
+		if i.Status == "RUNNING" {
+			continue
+		}
+		if stopped, ok := map[string]string{"STOPPING": "TERMINATED", "SUSPENDING": "SUSPENDED"}[i.Status]; ok {
+			log.Printf("Waiting for dependency %s to be %s before starting it again\n", instance, stopped)
+			if err := waitForDependency(instance, stopped); err != nil {
+				return err
+			}
+			i.Status = stopped
+		}
+
+		log.Printf("Starting dependency %s\n", instance)
+		if isThrottled("start", instance) {
+			return errThrottled
+		}
+		if i.Status == "SUSPENDED" {
+			_, err = service.Instances.Resume(*gceProjectName, zoneOfInstance(instance), instance).Do()
+		} else {
+			_, err = service.Instances.Start(*gceProjectName, zoneOfInstance(instance), instance).Do()
+		}
+		recordOperationResult("start", instance, err)
+		if err != nil {
+			return err
+		}
+		if err := waitForDependency(instance, "RUNNING"); err != nil {
+			return err
+		}
+	}
+	dependencies.Lock()
+	dependencies.running = true
+	dependencies.checked = time.Now()
+	dependencies.Unlock()
+	return nil
+}
+
+// noBoxOnline tells whether every box of the pool is offline in Jenkins.
+func noBoxOnline() bool {
+	for _, buildBox := range buildBoxesPool {
+		if !isNodeOffline(buildBox) {
+			return false
+		}
+	}
+	return true
+}
+
+func waitForDependency(instance string, status string) error {
+	deadline := time.Now().Add(dependencyStartTimeout)
+	for time.Now().Before(deadline) {
+		if isThrottled("get", instance) {
+			time.Sleep(time.Second * 3)
+			continue
+		}
+		i, err := service.Instances.Get(*gceProjectName, zoneOfInstance(instance), instance).Do()
+		recordOperationResult("get", instance, err)
+		if err == nil && i.Status == status {
+			log.Printf("==> dependency %s is %s\n", instance, status)
+			return nil
+		}
+		time.Sleep(time.Second * 3)
+	}
+	return fmt.Errorf("dependency %s did not reach %s within %s", instance, status, dependencyStartTimeout)
+}
+
+// stopDependenciesWhenPoolIsDown stops the dependency instances, in the
+// reverse order, once no box of the pool is running any more.
+func stopDependenciesWhenPoolIsDown() {
+	instances := splitList(*dependencyInstances)
+	if len(instances) == 0 || observerBuild || countPendingStarts() > 0 {
+		return
+	}
+
+	dependencies.Lock()
+	defer dependencies.Unlock()
+	if !dependencies.mayBeUp || dependencies.starting {
+		return
+	}
+
+	if !noBoxOnline() {
+		return
+	}
+	for _, buildBox := range buildBoxesPool {
+		status, err := cloudBoxStatus(buildBox)
+		if err != nil || (status != "TERMINATED" && status != "SUSPENDED" && status != "STOPPED") {
+			return
+		}
+	}
+
+	for i := len(instances) - 1; i >= 0; i-- {
+		log.Printf("No box running any more, stopping dependency %s\n", instances[i])
+		if isThrottled("stop", instances[i]) {
+			return
+		}
+		_, err := service.Instances.Stop(*gceProjectName, zoneOfInstance(instances[i]), instances[i]).Do()
+		recordOperationResult("stop", instances[i], err)
+		if err != nil {
+			log.Printf("Error stopping dependency %s: %s\n", instances[i], err.Error())
+			return
+		}
+	}
+	dependencies.running = false
+	dependencies.mayBeUp = false
+}
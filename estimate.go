@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+)
+
+// waitEstimate is the answer of /v1/estimate and the estimate_wait job.
+type waitEstimate struct {
+	EstimateSeconds *int64    `json:"estimateSeconds,omitempty"`
+	Reason          string    `json:"reason"`
+	QueueSize       int       `json:"queueSize"`
+	IdleExecutors   int       `json:"idleExecutors"`
+	StartableBoxes  int       `json:"startableBoxes"`
+	BootLeadSeconds int64     `json:"bootLeadSeconds"`
+	GeneratedAt     time.Time `json:"generatedAt"`
+}
+
+// estimateWait estimates how long a build submitted now would wait for an
+// executor, from the last observed queue and boxes. When every box is online
+// and busy the wait depends on the running builds, so no estimate is given.
+func estimateWait() waitEstimate {
+	observedState.Lock()
+	queueSize := observedState.demand.QueueSize
+	idleExecutors := 0
+	startableExecutors := 0
+	startableBoxes := 0
+	for _, buildBox := range buildBoxesPool {
+		box := observedBox(buildBox)
+		executors := box.Executors
+		if executors < 1 {
+			executors = 1
+		}
+		if box.NodeOffline {
+			if !isDraining(buildBox) {
+				startableBoxes++
+				startableExecutors += executors
+			}
+		} else if box.NodeIdle && !box.NodeTemporarilyOffline {
+			idleExecutors += executors
+		}
+	}
+	observedState.Unlock()
+
+	estimate := waitEstimate{
+		QueueSize:       queueSize,
+		IdleExecutors:   idleExecutors,
+		StartableBoxes:  startableBoxes,
+		BootLeadSeconds: int64(estimatedBootLeadTime().Seconds()),
+		GeneratedAt:     time.Now(),
+	}
+	var seconds int64
+	switch {
+	case queueSize < idleExecutors:
+		estimate.Reason = "an idle executor is available"
+	case queueSize < idleExecutors+startableExecutors:
+		seconds = estimate.BootLeadSeconds
+		estimate.Reason = "a box has to be started"
+	default:
+		estimate.Reason = "every box is busy, the wait depends on the running builds"
+		return estimate
+	}
+	estimate.EstimateSeconds = &seconds
+	return estimate
+}
+
+func serveEstimate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimateWait())
+}
+
+// printWaitEstimate looks at the queue and the boxes once and prints the
+// estimate, for the estimate_wait job.
+func printWaitEstimate() {
+	if queueSize := fetchQueueSize(); queueSize >= 0 {
+		recordDemand(queueSize)
+	}
+	snapshotNodeInfos(buildBoxesPool)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(estimateWait())
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pollInterval = time.Second * 8
+
+// eventsPollInterval is how often the queue is still polled while Jenkins
+// events are received, as a safety net for missed events.
+const eventsPollInterval = time.Minute * 5
+
+// minEventInterval is the least time between two iterations when woken up by
+// Jenkins events, so a busy controller does not get polled back to back.
+const minEventInterval = time.Second * 15
+
+// The subscription to Jenkins events is retried with an increasing delay
+// while the SSE gateway cannot be reached.
+const minSubscribeDelay = time.Second * 30
+const maxSubscribeDelay = time.Minute * 10
+
+// jenkinsEventChannels are the SSE gateway channels whose events wake the
+// loop up: jobs entering or leaving the queue, runs starting or ending and
+// agents connecting or going offline.
+var jenkinsEventChannels = []string{"job", "queue", "computer"}
+
+var wakeUp = make(chan struct{}, 1)
+var subscribeOnce sync.Once
+
+var jenkinsEventsConnected = struct {
+	sync.RWMutex
+	connected bool
+}{}
+
+// waitForNextIteration sleeps until the next poll is due, or until Jenkins
+// notifies a queue or job change. While events are received, the work that
+// depends on the time rather than on the queue is still checked every poll
+// interval.
+func waitForNextIteration() {
+	if !isJenkinsEventsConnected() {
+		select {
+		case <-wakeUp:
+			log.Println("Woken up by a Jenkins event")
+		case <-time.After(pollInterval):
+		}
+		return
+	}
+
+	since := time.Now()
+	tick := time.NewTicker(pollInterval)
+	defer tick.Stop()
+	for time.Since(since) < eventsPollInterval {
+		select {
+		case <-wakeUp:
+			if wait := minEventInterval - time.Since(since); wait > 0 {
+				time.Sleep(wait)
+			}
+			log.Println("Woken up by a Jenkins event")
+			return
+		case <-tick.C:
+			if timedWorkDue(since) {
+				return
+			}
+		}
+	}
+}
+
+// timedWorkDue tells whether starts are in progress, a refresh is running, a
+// pre-stop check is to be retried, the override expired, a box reached its
+// minimum uptime, a schedule window or the working hours opened or closed,
+// the blue/green switch retired the other colour since the given time, or
+// the upcoming maintenance events are to be checked again.
+func timedWorkDue(since time.Time) bool {
+	if countPendingStarts() > 0 || preStopRetryPending() {
+		return true
+	}
+
+	refresh.Lock()
+	refreshing := refresh.status.Running
+	refresh.Unlock()
+	if refreshing {
+		return true
+	}
+
+	override.Lock()
+	o := override.current
+	override.Unlock()
+	if o != nil && !time.Now().Before(o.Until) {
+		return true
+	}
+
+	now := time.Now()
+	for _, buildBox := range buildBoxesPool {
+		if pinnedState(buildBox, since) != pinnedState(buildBox, now) || minimumUptimeEnded(buildBox, since, now) {
+			return true
+		}
+	}
+	if workingHourAt(since) != workingHourAt(now) {
+		return true
+	}
+	if switched := currentSwitch().Since.Add(*switchDuration); len(greenBoxes) > 0 && switched.After(since) && !switched.After(now) {
+		return true
+	}
+	return *maintenanceDrainLead > 0 && time.Since(lastMaintenanceCheck) >= time.Minute
+}
+
+// subscribeToJenkinsEvents listens to the events published by the SSE
+// Gateway plugin, waking the scaling loop on each of them. The subscription
+// is retried in the background, the loop polling every few seconds until it
+// succeeds.
+func subscribeToJenkinsEvents() {
+	go func() {
+		delay := minSubscribeDelay
+		for {
+			var err error
+			func() {
+				defer recoverWorker()
+				err = listenToJenkinsEvents()
+			}()
+			if isJenkinsEventsConnected() {
+				delay = minSubscribeDelay
+			}
+			setJenkinsEventsConnected(false)
+			if err != nil {
+				log.Printf("Jenkins events not received, subscribing again in %s: %s\n", delay, err.Error())
+			}
+			time.Sleep(delay)
+
+			delay = delay * 2
+			if delay > maxSubscribeDelay {
+				delay = maxSubscribeDelay
+			}
+		}
+	}()
+}
+
+// listenToJenkinsEvents connects to the SSE gateway and wakes the loop up on
+// every event received, until the stream is interrupted.
+func listenToJenkinsEvents() error {
+	clientId := fmt.Sprintf("jenkins-nodes-auto-scaler-%d", time.Now().UnixNano())
+	resp, err := jenkinsRequest("events", "GET", "sse-gateway/connect?clientId="+clientId)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("SSE gateway connection answered with status %d", resp.StatusCode)
+	}
+
+	resp, err = jenkinsRequest("events", "GET", "sse-gateway/listen/"+clientId)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	if err := configureJenkinsEvents(clientId); err != nil {
+		return err
+	}
+	setJenkinsEventsConnected(true)
+	log.Println("Subscribed to Jenkins events")
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data:") {
+			select {
+			case wakeUp <- struct{}{}:
+			default:
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed")
+}
+
+func configureJenkinsEvents(clientId string) error {
+	var channels []map[string]string
+	for _, channel := range jenkinsEventChannels {
+		channels = append(channels, map[string]string{"jenkins_channel": channel})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"dispatcherId": clientId,
+		"subscribe":    channels,
+		"unsubscribe":  []map[string]string{},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := jenkinsRequestWithBody("events", "POST", fmt.Sprintf("sse-gateway/configure?batchId=%d", time.Now().UnixNano()), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("configuring subscriptions failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func isJenkinsEventsConnected() bool {
+	jenkinsEventsConnected.RLock()
+	defer jenkinsEventsConnected.RUnlock()
+	return jenkinsEventsConnected.connected
+}
+
+func setJenkinsEventsConnected(connected bool) {
+	jenkinsEventsConnected.Lock()
+	jenkinsEventsConnected.connected = connected
+	jenkinsEventsConnected.Unlock()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+var numExecutorsPattern = regexp.MustCompile(`<numExecutors>\d+</numExecutors>`)
+
+// raisedExecutors are the executor counts the boxes had before they were
+// raised, kept in stateFile so they are restored after a restart.
+var raisedExecutors = struct {
+	sync.Mutex
+	m map[string]int
+}{m: make(map[string]int)}
+
+// boxMaxExecutors are the maxima set per box with boxMaxExecutors, for the
+// boxes that can take more or fewer extra executors than the others.
+var boxMaxExecutors = map[string]int{}
+
+func loadBoxMaxExecutors() error {
+	pairs, err := parsePairs(*boxMaxExecutorsFlag)
+	if err != nil {
+		return err
+	}
+	for buildBox, value := range pairs {
+		executors, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		boxMaxExecutors[buildBox] = executors
+	}
+	return nil
+}
+
+// maxExecutors returns the executor count a box can be raised to,
+// maxExecutorsPerBuildBox unless set for the box.
+func maxExecutors(buildBox string) int {
+	if executors, ok := boxMaxExecutors[buildBox]; ok {
+		return executors
+	}
+	return *maxExecutorsPerBuildBox
+}
+
+// raiseExecutors absorbs as much of the queue as possible by temporarily
+// raising the executor count of the online boxes in rotation, up to their
+// maximum, and returns what is left of the queue.
+func raiseExecutors(queueSize int) int {
+	if *maxExecutorsPerBuildBox == 0 && len(boxMaxExecutors) == 0 {
+		return queueSize
+	}
+
+	raised := false
+	for _, buildBox := range orderForStart(schedulableBoxes()) {
+		if queueSize <= 0 {
+			break
+		}
+
+		data := fetchNodeInfo(buildBox)
+		if data.Unknown || data.Offline || data.TemporarilyOffline || data.NumExecutors == 0 {
+			continue
+		}
+		room := maxExecutors(buildBox) - data.NumExecutors
+		if room <= 0 {
+			continue
+		}
+		if room > queueSize {
+			room = queueSize
+		}
+
+		if err := setNodeExecutors(buildBox, data.NumExecutors+room); err != nil {
+			log.Printf("Failed to raise executors on %s: %s\n", buildBox, err.Error())
+			continue
+		}
+		log.Printf("Raised %s executors from %d to %d\n", buildBox, data.NumExecutors, data.NumExecutors+room)
+		raisedExecutors.Lock()
+		if _, ok := raisedExecutors.m[buildBox]; !ok {
+			raisedExecutors.m[buildBox] = data.NumExecutors
+		}
+		raisedExecutors.Unlock()
+		raised = true
+		queueSize = queueSize - room
+	}
+
+	if raised {
+		saveStateNow()
+	}
+	return queueSize
+}
+
+// restoreExecutors brings back the executor count the idle boxes had before
+// it was raised.
+func restoreExecutors() {
+	raisedExecutors.Lock()
+	original := make(map[string]int, len(raisedExecutors.m))
+	for buildBox, executors := range raisedExecutors.m {
+		original[buildBox] = executors
+	}
+	raisedExecutors.Unlock()
+
+	restored := false
+	for buildBox, executors := range original {
+		if !isNodeIdle(buildBox) {
+			continue
+		}
+		if err := setNodeExecutors(buildBox, executors); err != nil {
+			log.Printf("Failed to restore executors on %s: %s\n", buildBox, err.Error())
+			continue
+		}
+		log.Printf("Restored %s executors to %d\n", buildBox, executors)
+		raisedExecutors.Lock()
+		delete(raisedExecutors.m, buildBox)
+		raisedExecutors.Unlock()
+		restored = true
+	}
+
+	if restored {
+		saveStateNow()
+	}
+}
+
+// setNodeExecutors rewrites the number of executors in the node config.xml.
+func setNodeExecutors(buildBox string, executors int) error {
+	resp, err := jenkinsRequest("node_config", "GET", jenkinsPath("computer", buildBox, "config.xml"))
+	if err != nil {
+		return err
+	}
+	config, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("unexpected status %d reading %s config", resp.StatusCode, buildBox)
+	}
+	if !numExecutorsPattern.Match(config) {
+		return fmt.Errorf("no numExecutors found in %s config", buildBox)
+	}
+
+	invalidateNodeInfo(buildBox)
+	config = numExecutorsPattern.ReplaceAll(config, []byte("<numExecutors>"+strconv.Itoa(executors)+"</numExecutors>"))
+	resp, err = jenkinsRequestWithBody("node_config", "POST", jenkinsPath("computer", buildBox, "config.xml"), "application/xml", bytes.NewReader(config))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %d updating %s config", resp.StatusCode, buildBox)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// grafanaNotifier pushes events as annotations, tagged with the pool, the box
+// and the event type, so they can be overlaid on Grafana dashboards.
+type grafanaNotifier struct {
+	url    string
+	apiKey string
+}
+
+func (g *grafanaNotifier) Notify(event scalingEvent) error {
+	body, err := json.Marshal(struct {
+		Time int64    `json:"time"`
+		Tags []string `json:"tags"`
+		Text string   `json:"text"`
+	}{
+		Time: event.Time.UnixNano() / int64(1000000),
+		Tags: []string{"pool:" + event.Pool, "box:" + event.Box, event.Type},
+		Text: event.Message,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(g.url, "/")+"/api/annotations", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if g.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	}
+
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Grafana answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// buildRecord is a finished build, one JSON document per line of the
+// history file.
+type buildRecord struct {
+	Job             string    `json:"job"`
+	Number          int       `json:"number"`
+	StartedAt       time.Time `json:"startedAt"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	BuiltOn         string    `json:"builtOn"`
+	Label           string    `json:"label,omitempty"`
+}
+
+type JenkinsJobHistory struct {
+	Jobs []struct {
+		Url             string `json:"url"`
+		LabelExpression string `json:"labelExpression"`
+		Jobs            []struct {
+			Url string `json:"url"`
+		} `json:"jobs"`
+		Builds []struct {
+			Number    int    `json:"number"`
+			Timestamp int64  `json:"timestamp"`
+			Duration  int64  `json:"duration"`
+			Building  bool   `json:"building"`
+			BuiltOn   string `json:"builtOn"`
+		} `json:"builds"`
+	} `json:"jobs"`
+}
+
+func historyKey(job string, number int) string {
+	return fmt.Sprintf("%s#%d", job, number)
+}
+
+// loadHistoryKeys returns the builds already in the history file.
+func loadHistoryKeys() (map[string]bool, error) {
+	keys := map[string]bool{}
+	file, err := os.Open(*historyFile)
+	if os.IsNotExist(err) {
+		return keys, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record buildRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err == nil {
+			keys[historyKey(record.Job, record.Number)] = true
+		}
+	}
+	return keys, scanner.Err()
+}
+
+// historyInterval is how often the builds finished while auto scaling are
+// appended to the history file, looking at the last historyRecentBuilds
+// builds of every job.
+const historyInterval = time.Minute * 10
+const historyRecentBuilds = 10
+
+// history holds the builds already in the history file, loaded on first
+// use.
+var history = struct {
+	sync.Mutex
+	keys map[string]bool
+}{}
+
+// historyRecording tells when the finished builds were last recorded and
+// whether that walk is still running, apart from history which the walk
+// holds until it is done.
+var historyRecording = struct {
+	sync.Mutex
+	last    time.Time
+	running bool
+}{}
+
+// backfillHistory appends the last backfillBuilds finished builds of every
+// job in scope to the history file.
+func backfillHistory() {
+	added, err := appendHistory(*backfillBuilds)
+	if err != nil {
+		log.Printf("Error backfilling history into %s: %s\n", *historyFile, err.Error())
+		return
+	}
+	log.Printf("Backfilled %d builds into %s\n", added, *historyFile)
+}
+
+// recordFinishedBuilds keeps the history file up to date with the builds
+// finishing while auto scaling, when recordHistory is set. Folders are
+// walked in the background, so a large Jenkins does not hold up scaling.
+func recordFinishedBuilds(now time.Time) {
+	historyRecording.Lock()
+	due := *recordHistory && !historyRecording.running && now.Sub(historyRecording.last) >= historyInterval
+	if due {
+		historyRecording.last = now
+		historyRecording.running = true
+	}
+	historyRecording.Unlock()
+	if !due {
+		return
+	}
+
+	go func() {
+		defer recoverWorker()
+		defer func() {
+			historyRecording.Lock()
+			historyRecording.running = false
+			historyRecording.Unlock()
+		}()
+
+		added, err := appendHistory(historyRecentBuilds)
+		if err != nil {
+			log.Printf("Error recording finished builds into %s: %s\n", *historyFile, err.Error())
+			return
+		}
+		if added > 0 {
+			log.Printf("Recorded %d finished builds into %s\n", added, *historyFile)
+		}
+	}()
+}
+
+// appendHistory appends the last given number of finished builds of every
+// job in scope, walking down folders, to the history file, skipping the
+// builds it already holds, and returns how many were added.
+func appendHistory(builds int) (int, error) {
+	history.Lock()
+	defer history.Unlock()
+	if history.keys == nil {
+		keys, err := loadHistoryKeys()
+		if err != nil {
+			return 0, err
+		}
+		history.keys = keys
+	}
+	if err := refreshViewJobs(); err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(*historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	added := 0
+	folders := []string{""}
+	for len(folders) > 0 {
+		folder := folders[0]
+		folders = folders[1:]
+
+		jobs, err := fetchJobHistory(folder, builds)
+		if err != nil {
+			log.Printf("Error fetching build history of %q: %s\n", folder, err.Error())
+			continue
+		}
+		for _, job := range jobs.Jobs {
+			jobPath := jobPathFromUrl(job.Url)
+			if len(job.Jobs) > 0 {
+				folders = append(folders, jobPath)
+				continue
+			}
+			if (*jobFilter != "" && !matchesJobFilter(jobPath)) || (*jenkinsView != "" && !inView(jobPath)) {
+				continue
+			}
+			for _, build := range job.Builds {
+				key := historyKey(jobPath, build.Number)
+				if build.Building || history.keys[key] {
+					continue
+				}
+				record := buildRecord{
+					Job:             jobPath,
+					Number:          build.Number,
+					StartedAt:       time.Unix(0, build.Timestamp*int64(time.Millisecond)).UTC(),
+					DurationSeconds: float64(build.Duration) / 1000,
+					BuiltOn:         build.BuiltOn,
+					Label:           job.LabelExpression,
+				}
+				if err := encoder.Encode(record); err != nil {
+					return added, err
+				}
+				history.keys[key] = true
+				added++
+			}
+		}
+	}
+	return added, nil
+}
+
+func fetchJobHistory(folder string, builds int) (JenkinsJobHistory, error) {
+	var data JenkinsJobHistory
+	tree := fmt.Sprintf("jobs[url,labelExpression,jobs[url],builds[number,timestamp,duration,building,builtOn]{0,%d}]", builds)
+	path := jenkinsPath("api", "json")
+	if folder != "" {
+		path = jenkinsJobPath(folder, "api", "json")
+	}
+
+	resp, err := jenkinsRequest("job", "GET", path+"?tree="+tree)
+	if err != nil {
+		return data, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	return data, err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const imageCheckInterval = time.Hour
+
+var staleImageDays = expvar.NewMap("stale_image_days")
+
+// staleBoxes are the boxes whose boot disk was not created from the latest
+// image of imageFamily, with the age of the image it was created from.
+var staleBoxes = struct {
+	sync.RWMutex
+	m map[string]time.Duration
+}{m: make(map[string]time.Duration)}
+
+var lastImageCheck time.Time
+
+// checkImageStaleness compares the boot disk of every box with the latest
+// image of imageFamily, once an hour. Boxes whose disk comes from another
+// image older than maxImageAgeDays are flagged as stale.
+func checkImageStaleness() {
+	if *imageFamily == "" || time.Since(lastImageCheck) < imageCheckInterval {
+		return
+	}
+	lastImageCheck = time.Now()
+
+	project, family := *gceProjectName, *imageFamily
+	if i := strings.Index(family, "/"); i >= 0 {
+		project, family = family[:i], family[i+1:]
+	}
+	latest, err := service.Images.GetFromFamily(project, family).Do()
+	if err != nil {
+		log.Printf("Error getting the latest image of %s: %s\n", *imageFamily, err.Error())
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, buildBox := range buildBoxesPool {
+		wg.Add(1)
+		go func(b string) {
+			defer recoverWorker()
+			defer wg.Done()
+			checkBootDisk(b, latest.SelfLink)
+		}(buildBox)
+	}
+	wg.Wait()
+}
+
+func checkBootDisk(buildBox string, latestImage string) {
+	if isThrottled("get", buildBox) {
+		return
+	}
+	i, err := service.Instances.Get(*gceProjectName, instanceZone(buildBox), instanceName(buildBox)).Do()
+	recordOperationResult("get", buildBox, err)
+	if err != nil {
+		log.Printf("Failed to get instance data of %s: %v\n", buildBox, err)
+		return
+	}
+	for _, attached := range i.Disks {
+		if !attached.Boot {
+			continue
+		}
+		disk, err := service.Disks.Get(*gceProjectName, instanceZone(buildBox), path.Base(attached.Source)).Do()
+		recordOperationResult("get", buildBox, err)
+		if err != nil {
+			log.Printf("Failed to get the boot disk of %s: %v\n", buildBox, err)
+			return
+		}
+		image := path.Base(disk.SourceImage)
+		if disk.SourceImage == "" || image == path.Base(latestImage) {
+			markImageStaleness(buildBox, false, 0, image)
+			return
+		}
+
+		created, err := imageCreationTime(buildBox, disk.SourceImage)
+		if err != nil {
+			log.Printf("Failed to get the image %s of %s: %v\n", image, buildBox, err)
+			return
+		}
+		age := time.Since(created)
+		markImageStaleness(buildBox, age > time.Duration(*maxImageAgeDays)*24*time.Hour, age, image)
+		return
+	}
+}
+
+// imageCreations caches the creation time of the images by url, images
+// never changing once created.
+var imageCreations = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// imageCreationTime returns when the image a boot disk was created from was
+// itself created, from its url such as
+// https://www.googleapis.com/compute/v1/projects/debian-cloud/global/images/debian-9.
+func imageCreationTime(buildBox string, imageUrl string) (time.Time, error) {
+	imageCreations.Lock()
+	created, ok := imageCreations.m[imageUrl]
+	imageCreations.Unlock()
+	if ok {
+		return created, nil
+	}
+
+	project := *gceProjectName
+	segments := strings.Split(imageUrl, "/")
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i] == "projects" {
+			project = segments[i+1]
+		}
+	}
+	if isThrottled("get", buildBox) {
+		return time.Time{}, errThrottled
+	}
+	image, err := service.Images.Get(project, path.Base(imageUrl)).Do()
+	recordOperationResult("get", buildBox, err)
+	if err != nil {
+		return time.Time{}, err
+	}
+	created, err = time.Parse(time.RFC3339, image.CreationTimestamp)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	imageCreations.Lock()
+	imageCreations.m[imageUrl] = created
+	imageCreations.Unlock()
+	return created, nil
+}
+
+func markImageStaleness(buildBox string, stale bool, age time.Duration, image string) {
+	days := new(expvar.Float)
+	staleBoxes.Lock()
+	_, wasStale := staleBoxes.m[buildBox]
+	if stale {
+		staleBoxes.m[buildBox] = age
+		days.Set(age.Hours() / 24)
+	} else {
+		delete(staleBoxes.m, buildBox)
+	}
+	staleBoxes.Unlock()
+	staleImageDays.Set(buildBox, days)
+
+	if stale && !wasStale {
+		notify(eventStaleImage, buildBox, fmt.Sprintf("%s runs %s, %d days old, which is not the latest image of %s",
+			buildBox, image, int(age.Hours()/24), *imageFamily))
+	}
+}
+
+func isStale(buildBox string) bool {
+	staleBoxes.RLock()
+	defer staleBoxes.RUnlock()
+
+	_, stale := staleBoxes.m[buildBox]
+	return stale
+}
+
+// freshFirst moves the boxes running the latest image ahead of the stale
+// ones when preferFreshImages is set, keeping the current order otherwise.
+func freshFirst(buildBoxes []string) []string {
+	if !*preferFreshImages {
+		return buildBoxes
+	}
+	sorted := append([]string{}, buildBoxes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return !isStale(sorted[i]) && isStale(sorted[j])
+	})
+	return sorted
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"time"
+)
+
+var iterationsOverBudget = expvar.NewInt("iterations_over_budget")
+
+type phaseTiming struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// iterationTimer measures the phases of an iteration against
+// iterationBudget, so non-critical phases can be skipped once it is spent.
+type iterationTimer struct {
+	start    time.Time
+	lastMark time.Time
+	phases   []phaseTiming
+	skipped  []string
+}
+
+func startIteration() *iterationTimer {
+	now := time.Now()
+	return &iterationTimer{start: now, lastMark: now}
+}
+
+// mark records the time spent in a phase since the previous mark.
+func (t *iterationTimer) mark(phase string) {
+	now := time.Now()
+	t.phases = append(t.phases, phaseTiming{Phase: phase, Seconds: now.Sub(t.lastMark).Seconds()})
+	t.lastMark = now
+}
+
+func (t *iterationTimer) overBudget() bool {
+	return *iterationBudget > 0 && time.Since(t.start) > *iterationBudget
+}
+
+// remaining returns what is left of the budget, 0 meaning no limit.
+func (t *iterationTimer) remaining() time.Duration {
+	if *iterationBudget == 0 {
+		return 0
+	}
+	remaining := *iterationBudget - time.Since(t.start)
+	if remaining < time.Millisecond {
+		return time.Millisecond
+	}
+	return remaining
+}
+
+// withinBudget tells whether a non-critical phase should run, recording it
+// as skipped otherwise.
+func (t *iterationTimer) withinBudget(phase string) bool {
+	if t.overBudget() {
+		t.skipped = append(t.skipped, phase)
+		return false
+	}
+	return true
+}
+
+// finish logs the phase timings as a JSON warning when the budget was
+// exceeded.
+func (t *iterationTimer) finish() {
+	if !t.overBudget() {
+		return
+	}
+	iterationsOverBudget.Add(1)
+
+	warning, _ := json.Marshal(struct {
+		Event          string        `json:"event"`
+		BudgetSeconds  float64       `json:"budgetSeconds"`
+		ElapsedSeconds float64       `json:"elapsedSeconds"`
+		Phases         []phaseTiming `json:"phases"`
+		Skipped        []string      `json:"skipped"`
+	}{"iteration_over_budget", iterationBudget.Seconds(), time.Since(t.start).Seconds(), t.phases, t.skipped})
+	log.Printf("WARNING %s\n", warning)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// draining holds the boxes taken out of rotation ahead of a host
+// maintenance event, until their instance has been stopped.
+var draining = struct {
+	sync.RWMutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+var lastMaintenanceCheck time.Time
+
+func isDraining(buildBox string) bool {
+	draining.RLock()
+	defer draining.RUnlock()
+	return draining.m[buildBox]
+}
+
+// outOfRotation tells whether a box is being drained, refreshed, retired by
+// a blue/green switch or is scheduled to be off, so it must not be picked to
+// run builds.
+func outOfRotation(buildBox string) bool {
+	return isDraining(buildBox) || isRefreshing(buildBox) || isRetired(buildBox) || isPinnedOff(buildBox)
+}
+
+// schedulableBoxes returns the pool without the boxes out of rotation.
+func schedulableBoxes() []string {
+	var buildBoxes []string
+	for _, buildBox := range buildBoxesPool {
+		if !outOfRotation(buildBox) {
+			buildBoxes = append(buildBoxes, buildBox)
+		}
+	}
+	return buildBoxes
+}
+
+// drainBoxesBeforeMaintenance toggles offline the running boxes with a GCE
+// maintenance event starting within maintenanceDrainLead, so they stop
+// taking builds and get stopped as soon as they are idle. Demand left
+// uncovered is met by starting other boxes as usual.
+func drainBoxesBeforeMaintenance() {
+	if *maintenanceDrainLead <= 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	if time.Since(lastMaintenanceCheck) >= time.Minute {
+		lastMaintenanceCheck = time.Now()
+		for _, buildBox := range buildBoxesPool {
+			wg.Add(1)
+			go func(b string) {
+				defer recoverWorker()
+				defer wg.Done()
+				checkUpcomingMaintenance(b)
+			}(buildBox)
+		}
+		wg.Wait()
+	}
+
+	if observerBuild {
+		return
+	}
+	for _, buildBox := range buildBoxesPool {
+		if !isDraining(buildBox) || !isNodeIdle(buildBox) {
+			continue
+		}
+		wg.Add(1)
+		go func(b string) {
+			defer recoverWorker()
+			defer wg.Done()
+			disableNode(b)
+			if !isCloudBoxRunning(b) {
+				draining.Lock()
+				delete(draining.m, b)
+				draining.Unlock()
+			}
+		}(buildBox)
+	}
+	wg.Wait()
+}
+
+func checkUpcomingMaintenance(buildBox string) {
+	if isThrottled("get", buildBox) {
+		return
+	}
+	i, err := service.Instances.Get(*gceProjectName, instanceZone(buildBox), instanceName(buildBox)).Do()
+	recordOperationResult("get", buildBox, err)
+	if err != nil {
+		log.Printf("Failed to get instance data for %s: %v\n", buildBox, err)
+		return
+	}
+
+	if i.Status != "RUNNING" {
+		draining.Lock()
+		delete(draining.m, buildBox)
+		draining.Unlock()
+		return
+	}
+	if i.ResourceStatus == nil || i.ResourceStatus.UpcomingMaintenance == nil || isDraining(buildBox) {
+		return
+	}
+
+	start, err := time.Parse(time.RFC3339, i.ResourceStatus.UpcomingMaintenance.WindowStartTime)
+	if err != nil || time.Until(start) > *maintenanceDrainLead {
+		return
+	}
+
+	draining.Lock()
+	draining.m[buildBox] = true
+	draining.Unlock()
+
+	log.Printf("%s has host maintenance scheduled at %s, draining it\n", buildBox, start.Format(time.RFC3339))
+	notify(eventMaintenance, buildBox, fmt.Sprintf("Draining %s ahead of host maintenance at %s", buildBox, start.Format(time.RFC3339)))
+	if !isNodeTemporarilyOffline(buildBox) {
+		toggleNodeStatus(buildBox, "offline")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var throttledOperations = expvar.NewMap("gce_throttled_operations")
+var throttledTotal = expvar.NewInt("gce_throttled_total")
+
+// startHttpServer serves the expvar metrics under /debug/vars, the scaler
+// state under /v1/state, the wait estimate under /v1/estimate and the status
+// page under /status, to the callers authenticate lets through.
+func startHttpServer(address string) {
+	if address == "" {
+		return
+	}
+
+	http.HandleFunc("/v1/state", requireRole(roleRead, serveState))
+	http.HandleFunc("/v1/estimate", requireRole(roleRead, serveEstimate))
+	http.HandleFunc("/status", requireRole(roleRead, serveStatus))
+	http.HandleFunc("/v1/refresh", serveRefresh)
+	http.HandleFunc("/v1/switch", serveSwitch)
+	http.HandleFunc("/v1/override", serveOverride)
+
+	server := &http.Server{Addr: address, Handler: authenticate(http.DefaultServeMux), TLSConfig: apiTlsConfig()}
+	go func() {
+		log.Printf("Serving metrics on %s/debug/vars and state on %s/v1/state\n", address, address)
+		var err error
+		if *apiTlsCert != "" {
+			err = server.ListenAndServeTLS(*apiTlsCert, *apiTlsKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			log.Printf("Error serving metrics: %s\n", err.Error())
+		}
+	}()
+}
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var jenkinsLatency = expvar.NewMap("jenkins_latency_seconds")
+var jenkinsLatencyMutex sync.Mutex
+
+// histogram is a cumulative histogram in the same shape Prometheus uses,
+// rendered as JSON so it can be published through expvar.
+type histogram struct {
+	sync.Mutex
+	buckets []float64
+	counts  []int64
+	count   int64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			h.counts[i] += 1
+		}
+	}
+	h.count += 1
+	h.sum += value
+}
+
+func (h *histogram) String() string {
+	h.Lock()
+	defer h.Unlock()
+
+	buckets := make(map[string]int64, len(h.buckets)+1)
+	for i, bucket := range h.buckets {
+		buckets[strconv.FormatFloat(bucket, 'f', -1, 64)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.count
+
+	content, _ := json.Marshal(struct {
+		Buckets map[string]int64 `json:"buckets"`
+		Count   int64            `json:"count"`
+		Sum     float64          `json:"sum"`
+	}{buckets, h.count, h.sum})
+	return string(content)
+}
+
+func observeJenkinsLatency(endpoint string, duration time.Duration) {
+	jenkinsLatencyMutex.Lock()
+	h, ok := jenkinsLatency.Get(endpoint).(*histogram)
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		jenkinsLatency.Set(endpoint, h)
+	}
+	jenkinsLatencyMutex.Unlock()
+
+	h.Observe(duration.Seconds())
+}
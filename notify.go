@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventScaleUp     = "scale_up"
+	eventScaleDown   = "scale_down"
+	eventFailure     = "failure"
+	eventDigest      = "digest"
+	eventMaintenance = "maintenance"
+	eventTransition  = "state_transition"
+	eventStaleImage  = "stale_image"
+	eventRefresh     = "refresh"
+	eventSwitch      = "switch"
+	eventOverride    = "override"
+	eventRecovery    = "recovery"
+)
+
+// scalingEvent describes something the scaler did, or failed to do, to a box.
+type scalingEvent struct {
+	Type    string    `json:"type"`
+	Kind    string    `json:"kind,omitempty"`
+	Pool    string    `json:"pool"`
+	Box     string    `json:"box"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+type notifier interface {
+	Notify(event scalingEvent) error
+}
+
+// notificationRoute sends the events of a type, for a pool, to a sink.
+// Both the event type and the pool can be "*" to match anything.
+type notificationRoute struct {
+	eventType string
+	pool      string
+	sink      string
+}
+
+var notifiers = map[string]notifier{}
+var notificationRoutes []notificationRoute
+
+var digest = struct {
+	sync.Mutex
+	day    int
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+func setupNotifiers() error {
+	if *grafanaUrl != "" {
+		notifiers["grafana"] = &grafanaNotifier{url: *grafanaUrl, apiKey: *grafanaApiKey}
+	}
+	if *slackWebhookUrl != "" {
+		notifiers["slack"] = &slackNotifier{webhookUrl: *slackWebhookUrl}
+	}
+	if *natsUrl != "" {
+		u, err := url.Parse(*natsUrl)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid NATS url %q", *natsUrl)
+		}
+		notifiers["nats"] = &natsNotifier{url: u, subject: *natsSubject}
+	}
+	if *kafkaRestProxyUrl != "" {
+		notifiers["kafka"] = &kafkaNotifier{restProxyUrl: *kafkaRestProxyUrl, topic: *kafkaTopic}
+	}
+	if *pagerDutyRoutingKey != "" {
+		notifiers["pagerduty"] = &pagerDutyNotifier{routingKey: *pagerDutyRoutingKey}
+	}
+	if *smtpAddress != "" && *emailTo != "" {
+		notifiers["email"] = &emailNotifier{address: *smtpAddress, from: *emailFrom, to: strings.Split(*emailTo, ",")}
+	}
+
+	routes, err := parseNotificationRoutes(*notificationRoutesFlag)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if _, ok := notifiers[route.sink]; !ok {
+			return fmt.Errorf("notification route to %s, which is not configured", route.sink)
+		}
+	}
+	notificationRoutes = routes
+	return nil
+}
+
+// parseNotificationRoutes parses comma separated rules in the form
+// event[@pool]=sink, e.g. "failure=pagerduty,scale_up@android=slack".
+func parseNotificationRoutes(value string) ([]notificationRoute, error) {
+	var routes []notificationRoute
+	if value == "" {
+		return routes, nil
+	}
+	for _, rule := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid notification route %q", rule)
+		}
+		route := notificationRoute{eventType: parts[0], pool: "*", sink: parts[1]}
+		if i := strings.Index(parts[0], "@"); i >= 0 {
+			route.eventType = parts[0][:i]
+			route.pool = parts[0][i+1:]
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// notify hands the event to the sinks it is routed to, or to every sink when
+// no route is configured, apart from email only getting the digest and
+// PagerDuty only the failures and recoveries. The bus sinks get every event, the others
+// only those not throttled. Failures are logged rather than getting in the
+// way of scaling.
+func notify(eventType string, buildBox string, message string) {
+	notifyKind(eventType, "", buildBox, message)
+}
+
+// notifyKind notifies an event telling what failed or recovered with its
+// kind, e.g. jenkins_unreachable, so a recovery only resolves the failures
+// of the same kind.
+func notifyKind(eventType string, kind string, buildBox string, message string) {
+	event := scalingEvent{
+		Type:    eventType,
+		Kind:    kind,
+		Pool:    *poolName,
+		Box:     buildBox,
+		Message: message,
+		Time:    time.Now(),
+	}
+
+	if eventType != eventDigest && eventType != eventTransition {
+		recordAction(event)
+		digest.Lock()
+		digest.counts[eventType] += 1
+		digest.Unlock()
+	}
+
+	for _, sink := range sinksFor(event) {
+		if busSinks[sink] {
+			send(sink, event)
+		}
+	}
+	if event.Type == eventTransition {
+		return
+	}
+
+	ok, summaries := throttleNotification(event)
+	for _, summary := range summaries {
+		dispatch(summary)
+	}
+	if ok {
+		dispatch(event)
+	}
+}
+
+// dispatch sends the event to the sinks it is routed to, apart from the bus
+// sinks, which get every event as it happens rather than throttled.
+func dispatch(event scalingEvent) {
+	for _, sink := range sinksFor(event) {
+		if !busSinks[sink] {
+			send(sink, event)
+		}
+	}
+}
+
+func send(sink string, event scalingEvent) {
+	if err := notifiers[sink].Notify(event); err != nil {
+		log.Printf("Error sending %s notification for %s to %s: %s\n", event.Type, event.Box, sink, err.Error())
+	}
+}
+
+// sinksFor returns the sinks an event is routed to. State transitions only
+// ever go to the bus sinks.
+func sinksFor(event scalingEvent) []string {
+	var sinks []string
+	if len(notificationRoutes) == 0 {
+		for sink := range notifiers {
+			if event.Type == eventTransition && !busSinks[sink] {
+				continue
+			}
+			if sink == "email" && event.Type != eventDigest {
+				continue
+			}
+			if sink == "pagerduty" && event.Type != eventFailure && event.Type != eventRecovery {
+				continue
+			}
+			sinks = append(sinks, sink)
+		}
+		return sinks
+	}
+
+	seen := map[string]bool{}
+	for _, route := range notificationRoutes {
+		if event.Type == eventTransition && !busSinks[route.sink] {
+			continue
+		}
+		if (route.eventType == "*" || route.eventType == event.Type) && (route.pool == "*" || route.pool == event.Pool) && !seen[route.sink] {
+			seen[route.sink] = true
+			sinks = append(sinks, route.sink)
+		}
+	}
+	return sinks
+}
+
+// sendDailyDigest notifies and publishes a summary of the previous day the
+// first time it is called on a new day.
+func sendDailyDigest(now time.Time) {
+	digest.Lock()
+	if digest.day == 0 {
+		digest.day = now.YearDay()
+		startDailySummary(now)
+	}
+	if digest.day == now.YearDay() {
+		digest.Unlock()
+		return
+	}
+	counts := digest.counts
+	digest.counts = make(map[string]int)
+	digest.day = now.YearDay()
+	digest.Unlock()
+
+	summary := summarizeDay(now, counts)
+	notify(eventDigest, "", summary.String())
+	publishSummaryToJenkins(summary)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// errObserver is returned for any mutating call attempted by a binary built
+// with the observer tag, which only ever reads from Jenkins and GCE.
+var errObserver = errors.New("mutating calls are disabled in observer builds")
+
+// readOnlyTransport refuses every request but reads, so the GCE client of an
+// observer build cannot change any instance whatever the calling code does.
+type readOnlyTransport struct {
+	base http.RoundTripper
+}
+
+func (t *readOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil, errObserver
+	}
+	return t.base.RoundTrip(req)
+}
+
+// guardClient makes the client read only in observer builds.
+func guardClient(client *http.Client) *http.Client {
+	if !observerBuild {
+		return client
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	guarded := *client
+	guarded.Transport = &readOnlyTransport{base: base}
+	return &guarded
+}
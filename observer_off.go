@@ -0,0 +1,6 @@
+//go:build !observer
+// +build !observer
+
+package main
+
+const observerBuild = false
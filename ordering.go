@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var lastUsed = struct {
+	sync.RWMutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+var lastStartedBox = struct {
+	sync.Mutex
+	name string
+}{}
+
+var boxCosts = map[string]float64{}
+
+// boxCost returns the configured cost weight of a box, 1 by default.
+func boxCost(buildBox string) float64 {
+	if cost, ok := boxCosts[buildBox]; ok {
+		return cost
+	}
+	return 1
+}
+
+// sortByCost orders the boxes from the cheapest to the most expensive,
+// reserved boxes first, keeping the current order between boxes with the
+// same weight.
+func sortByCost(buildBoxes []string) []string {
+	sorted := append([]string{}, buildBoxes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if reservedBoxes[sorted[i]] != reservedBoxes[sorted[j]] {
+			return reservedBoxes[sorted[i]]
+		}
+		return boxCost(sorted[i]) < boxCost(sorted[j])
+	})
+	return sorted
+}
+
+// sortByCostDescending orders the boxes from the most expensive to the
+// cheapest, reserved boxes last, which is the order they should be stopped in.
+func sortByCostDescending(buildBoxes []string) []string {
+	sorted := append([]string{}, buildBoxes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if reservedBoxes[sorted[i]] != reservedBoxes[sorted[j]] {
+			return reservedBoxes[sorted[j]]
+		}
+		return boxCost(sorted[i]) > boxCost(sorted[j])
+	})
+	return sorted
+}
+
+func loadBoxCosts() error {
+	pairs, err := parsePairs(*boxCostWeights)
+	if err != nil {
+		return err
+	}
+	for buildBox, value := range pairs {
+		cost, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		boxCosts[buildBox] = cost
+	}
+	return nil
+}
+
+// orderForStart returns the pool in the order boxes should be started,
+// according to the configured selection policy.
+func orderForStart(buildBoxes []string) []string {
+	ordered := append([]string{}, buildBoxes...)
+	switch *selectionPolicy {
+	case "sticky":
+		lastUsed.RLock()
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return lastUsed.m[ordered[i]].After(lastUsed.m[ordered[j]])
+		})
+		lastUsed.RUnlock()
+	case "spread":
+		uptimes := make(map[string]time.Duration, len(ordered))
+		for _, buildBox := range ordered {
+			uptimes[buildBox] = uptime(buildBox)
+		}
+		shuffle(ordered)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return uptimes[ordered[i]] < uptimes[ordered[j]]
+		})
+	case "round-robin":
+		lastStartedBox.Lock()
+		for i, buildBox := range ordered {
+			if buildBox == lastStartedBox.name {
+				ordered = append(append([]string{}, ordered[i+1:]...), ordered[:i+1]...)
+				break
+			}
+		}
+		lastStartedBox.Unlock()
+	default:
+		shuffle(ordered)
+	}
+	return ordered
+}
+
+// markUsed records that a box was busy, so its caches are considered warm.
+func markUsed(buildBox string) {
+	lastUsed.Lock()
+	lastUsed.m[buildBox] = time.Now()
+	lastUsed.Unlock()
+}
+
+func markStarted(buildBox string) {
+	markUsed(buildBox)
+
+	lastStartedBox.Lock()
+	lastStartedBox.name = buildBox
+	lastStartedBox.Unlock()
+}
+
+// uptime returns how long a box has been powered on in total, from the idle
+// and busy time recorded by usage, which is kept across restarts in
+// stateFile.
+func uptime(buildBox string) time.Duration {
+	usage.Lock()
+	defer usage.Unlock()
+
+	box := usage.boxes[buildBox]
+	if box == nil {
+		return 0
+	}
+	return time.Duration((box.IdleSeconds + box.BusySeconds) * float64(time.Second))
+}
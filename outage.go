@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// lastKnownGood is the last demand assessment made while Jenkins answered,
+// persisted in stateFile so it survives a restart during an outage.
+type lastKnownGood struct {
+	QueueSize   int       `json:"queueSize"`
+	OnlineBoxes []string  `json:"onlineBoxes"`
+	At          time.Time `json:"at"`
+}
+
+var outage = struct {
+	sync.Mutex
+	since         time.Time
+	lastKnownGood *lastKnownGood
+	heldBoxes     map[string]bool
+}{heldBoxes: make(map[string]bool)}
+
+// recordLastKnownGood keeps the demand and the online boxes of an iteration
+// where Jenkins answered, and reconciles the boxes started while it didn't.
+func recordLastKnownGood(queueSize int) {
+	var online []string
+	observedState.Lock()
+	for _, buildBox := range buildBoxesPool {
+		if !observedBox(buildBox).NodeOffline {
+			online = append(online, buildBox)
+		}
+	}
+	observedState.Unlock()
+
+	outage.Lock()
+	since := outage.since
+	held := outage.heldBoxes
+	outage.since = time.Time{}
+	outage.heldBoxes = make(map[string]bool)
+	outage.lastKnownGood = &lastKnownGood{QueueSize: queueSize, OnlineBoxes: online, At: time.Now()}
+	outage.Unlock()
+
+	if since.IsZero() {
+		return
+	}
+	log.Printf("Jenkins is back after %s\n", time.Since(since).Round(time.Second))
+	notifyKind(eventRecovery, "jenkins_unreachable", "", "Jenkins is reachable again")
+	reconcileHeldBoxes(held, queueSize)
+}
+
+// handleJenkinsOutage is called instead of scaling while Jenkins cannot be
+// reached. Nothing is changed, unless outageHoldCapacity is set and the
+// outage lasts longer than outageThreshold, in which case the boxes online
+// at the last known good assessment are kept running.
+func handleJenkinsOutage() {
+	outage.Lock()
+	if outage.since.IsZero() {
+		outage.since = time.Now()
+		outage.Unlock()
+		log.Println("Jenkins is unreachable, holding off scaling decisions")
+		notifyKind(eventFailure, "jenkins_unreachable", "", "Jenkins is unreachable, holding off scaling decisions")
+		return
+	}
+	since := outage.since
+	known := outage.lastKnownGood
+	outage.Unlock()
+
+	if observerBuild || !*outageHoldCapacity || known == nil || time.Since(since) < *outageThreshold {
+		return
+	}
+
+	for _, buildBox := range known.OnlineBoxes {
+		if !inPool(buildBox) || isDraining(buildBox) || isPendingStart(buildBox) {
+			continue
+		}
+		status, err := cloudBoxStatus(buildBox)
+		if err != nil || status == "RUNNING" || status == "STAGING" || status == "PROVISIONING" {
+			continue
+		}
+		log.Printf("Holding capacity during the Jenkins outage, starting %s\n", buildBox)
+		if startCloudBox(buildBox) == nil {
+			outage.Lock()
+			outage.heldBoxes[buildBox] = true
+			outage.Unlock()
+		}
+	}
+}
+
+// reconcileHeldBoxes brings the boxes started during an outage online when
+// there are jobs waiting, or stops them otherwise, like interrupted toggles.
+func reconcileHeldBoxes(held map[string]bool, queueSize int) {
+	var wg sync.WaitGroup
+	for buildBox := range held {
+		wg.Add(1)
+		go func(b string) {
+			defer recoverWorker()
+			defer wg.Done()
+			if !isNodeOffline(b) {
+				return
+			}
+			if queueSize > 0 {
+				log.Printf("Bringing %s, started during the outage, online\n", b)
+				enableNode(b)
+			} else {
+				log.Printf("Stopping %s, started during the outage\n", b)
+				stopCloudBox(b)
+			}
+		}(buildBox)
+	}
+	wg.Wait()
+}
+
+func inPool(buildBox string) bool {
+	for _, b := range buildBoxesPool {
+		if b == buildBox {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var overrideBoxesMetric = expvar.NewInt("override_boxes")
+var overrideExpiresMetric = expvar.NewInt("override_expires_at")
+
+// capacityOverride forces at least Boxes boxes online until Until, whatever
+// the queue says. It is kept in stateFile.
+type capacityOverride struct {
+	Boxes  int       `json:"boxes"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+var override = struct {
+	sync.Mutex
+	current *capacityOverride
+}{}
+
+// setOverride replaces the override in force, saving the state straight
+// away so a restart does not drop an override just set.
+func setOverride(o *capacityOverride) {
+	publishOverride(o)
+	saveStateNow()
+}
+
+func publishOverride(o *capacityOverride) {
+	override.Lock()
+	override.current = o
+	override.Unlock()
+
+	if o == nil {
+		overrideBoxesMetric.Set(0)
+		overrideExpiresMetric.Set(0)
+		return
+	}
+	overrideBoxesMetric.Set(int64(o.Boxes))
+	overrideExpiresMetric.Set(o.Until.Unix())
+}
+
+// activeOverride returns the override in force, clearing it once expired.
+func activeOverride() *capacityOverride {
+	override.Lock()
+	o := override.current
+	override.Unlock()
+	if o == nil || time.Now().Before(o.Until) {
+		return o
+	}
+
+	setOverride(nil)
+	log.Printf("Override of %d boxes expired\n", o.Boxes)
+	notify(eventOverride, "", fmt.Sprintf("Override of %d boxes on pool %s expired", o.Boxes, *poolName))
+	return nil
+}
+
+// overrideMinimum returns the number of boxes the override keeps online, 0
+// when there is none.
+func overrideMinimum() int {
+	if o := activeOverride(); o != nil {
+		return o.Boxes
+	}
+	return 0
+}
+
+func onlineBoxes() []string {
+	var online []string
+	for _, buildBox := range buildBoxesPool {
+		if !isNodeOffline(buildBox) && !isNodeTemporarilyOffline(buildBox) {
+			online = append(online, buildBox)
+		}
+	}
+	return online
+}
+
+// applyOverride starts boxes until the override minimum is online, counting
+// the boxes already starting. The boxes are started concurrently, the loop
+// waiting for them like for any other start, or only issued with
+// asyncOperations so the loop carries on meanwhile.
+func applyOverride() {
+	minimum := overrideMinimum()
+	if minimum == 0 || observerBuild {
+		return
+	}
+
+	missing := minimum - len(onlineBoxes()) - countPendingStarts()
+	if missing <= 0 {
+		return
+	}
+	log.Printf("Override requires %d boxes online, starting %d more\n", minimum, missing)
+
+	var wg sync.WaitGroup
+	for _, buildBox := range targetColourFirst(reservedFirst(freshFirst(orderForStart(schedulableBoxes())))) {
+		if missing == 0 {
+			break
+		}
+		if isPendingStart(buildBox) || (!isNodeOffline(buildBox) && !isNodeTemporarilyOffline(buildBox)) {
+			continue
+		}
+		if *asyncOperations {
+			if beginStart(buildBox) {
+				missing--
+			}
+			continue
+		}
+		missing--
+		wg.Add(1)
+		go func(b string) {
+			defer recoverWorker()
+			defer wg.Done()
+			enableNode(b)
+		}(buildBox)
+	}
+	wg.Wait()
+}
+
+// limitStopsForOverride keeps enough of the boxes about to be stopped to
+// leave the override minimum online.
+func limitStopsForOverride(buildBoxes []string) []string {
+	minimum := overrideMinimum()
+	if minimum == 0 {
+		return buildBoxes
+	}
+
+	allowed := len(onlineBoxes()) - minimum
+	if allowed < 0 {
+		allowed = 0
+	}
+	if len(buildBoxes) > allowed {
+		log.Printf("Override requires %d boxes online, stopping %d of %d idle boxes\n", minimum, allowed, len(buildBoxes))
+		return buildBoxes[:allowed]
+	}
+	return buildBoxes
+}
+
+// serveOverride returns the override in force. POST sets one from ?boxes=
+// and ?for=, e.g. ?boxes=6&for=2h, with an optional ?reason=, and DELETE
+// cancels it; both require the operate role and are refused by observer
+// builds.
+func serveOverride(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "DELETE":
+		if !hasRole(r, roleOperate) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if observerBuild {
+			http.Error(w, errObserver.Error(), http.StatusConflict)
+			return
+		}
+		if r.Method == "DELETE" {
+			setOverride(nil)
+			log.Println("Override cancelled")
+			notify(eventOverride, "", "Override on pool "+*poolName+" cancelled")
+			break
+		}
+
+		boxes, err := strconv.Atoi(r.URL.Query().Get("boxes"))
+		if err != nil || boxes < 1 || boxes > len(buildBoxesPool) {
+			http.Error(w, fmt.Sprintf("boxes should be between 1 and %d", len(buildBoxesPool)), http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(r.URL.Query().Get("for"))
+		if err != nil || duration <= 0 {
+			http.Error(w, "for should be a positive duration, e.g. 2h", http.StatusBadRequest)
+			return
+		}
+		o := &capacityOverride{Boxes: boxes, Until: time.Now().Add(duration), Reason: r.URL.Query().Get("reason")}
+		setOverride(o)
+		log.Printf("Override of %d boxes until %s\n", o.Boxes, o.Until.Format(time.RFC3339))
+		notify(eventOverride, "", fmt.Sprintf("Override of %d boxes on pool %s until %s %s", o.Boxes, *poolName, o.Until.Format(time.RFC3339), o.Reason))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Override *capacityOverride `json:"override"`
+	}{activeOverride()})
+}
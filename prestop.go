@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// preStopFailingSince records when the pre-stop check of a box started
+// failing, so it can be overridden after preStopMaxWait.
+var preStopFailingSince = struct {
+	sync.Mutex
+	m map[string]time.Time
+}{m: make(map[string]time.Time)}
+
+// minimumUptime is how long a box is kept up after it was started, since
+// that's the minimum charge Google applies per instance.
+const minimumUptime = time.Minute * 10
+
+// readyToStop is the gate every stop of a running box goes through, whether
+// it is scaled down, drained, scheduled off, retired or refreshed: a box is
+// kept up for at least 10 minutes after it was started and until its
+// pre-stop check passes.
+func readyToStop(buildBox string) bool {
+	if !isCloudBoxRunning(buildBox) {
+		return true
+	}
+
+	lastStarted.RLock()
+	started := lastStarted.m[buildBox]
+	lastStarted.RUnlock()
+	if !started.IsZero() && started.Add(minimumUptime).After(time.Now()) {
+		log.Printf("%s is idle but has been up for less than 10 minutes", buildBox)
+		return false
+	}
+
+	return preStopCheckPassed(buildBox)
+}
+
+// preStopCheckPassed runs the configured pre-stop probe and command against
+// an idle box, e.g. to make sure artifacts have finished uploading. A box
+// failing its checks for longer than preStopMaxWait is stopped regardless.
+func preStopCheckPassed(buildBox string) bool {
+	if *preStopProbeUrl == "" && *preStopCommand == "" {
+		return true
+	}
+
+	err := runPreStopProbe(buildBox)
+	if err == nil {
+		err = runPreStopCommand(buildBox)
+	}
+
+	preStopFailingSince.Lock()
+	defer preStopFailingSince.Unlock()
+	if err == nil {
+		delete(preStopFailingSince.m, buildBox)
+		return true
+	}
+
+	since, ok := preStopFailingSince.m[buildBox]
+	if !ok {
+		since = time.Now()
+		preStopFailingSince.m[buildBox] = since
+	}
+	if *preStopMaxWait > 0 && time.Since(since) > *preStopMaxWait {
+		log.Printf("%s pre-stop check still failing after %s, stopping it anyway: %s\n", buildBox, *preStopMaxWait, err.Error())
+		delete(preStopFailingSince.m, buildBox)
+		return true
+	}
+
+	log.Printf("%s is idle but its pre-stop check failed: %s\n", buildBox, err.Error())
+	return false
+}
+
+// resetPreStopCheck forgets a failing pre-stop check once the box is busy
+// again or stopped, so preStopMaxWait counts from its next failure only.
+func resetPreStopCheck(buildBox string) {
+	preStopFailingSince.Lock()
+	delete(preStopFailingSince.m, buildBox)
+	preStopFailingSince.Unlock()
+}
+
+// preStopRetryPending tells whether a box is waiting on a failing pre-stop
+// check, which is run again every iteration.
+func preStopRetryPending() bool {
+	preStopFailingSince.Lock()
+	defer preStopFailingSince.Unlock()
+	return len(preStopFailingSince.m) > 0
+}
+
+// minimumUptimeEnded tells whether the minimum uptime of a box ran out
+// between the two given times.
+func minimumUptimeEnded(buildBox string, since time.Time, now time.Time) bool {
+	lastStarted.RLock()
+	started := lastStarted.m[buildBox]
+	lastStarted.RUnlock()
+	if started.IsZero() {
+		return false
+	}
+	end := started.Add(minimumUptime)
+	return end.After(since) && !end.After(now)
+}
+
+func expandBoxPlaceholders(template string, buildBox string) string {
+	return strings.NewReplacer("{box}", buildBox, "{instance}", instanceName(buildBox)).Replace(template)
+}
+
+func runPreStopProbe(buildBox string) error {
+	if *preStopProbeUrl == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *preStopTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", expandBoxPlaceholders(*preStopProbeUrl, buildBox), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("probe answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func runPreStopCommand(buildBox string) error {
+	if *preStopCommand == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *preStopTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", expandBoxPlaceholders(*preStopCommand, buildBox))
+	cmd.Env = append(os.Environ(), "BOX="+buildBox, "INSTANCE="+instanceName(buildBox))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
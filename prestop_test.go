@@ -0,0 +1,79 @@
+//go:build !observer
+// +build !observer
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func stringValue(value string) *string {
+	return &value
+}
+
+func durationValue(value time.Duration) *time.Duration {
+	return &value
+}
+
+// fakeGce answers instance gets with the given status and counts the stops.
+func fakeGce(t *testing.T, status string) *int32 {
+	var stops int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/stop") {
+			atomic.AddInt32(&stops, 1)
+			w.Write([]byte(`{"name":"stop","status":"DONE"}`))
+			return
+		}
+		w.Write([]byte(`{"name":"box","status":"` + status + `"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	var err error
+	service, err = compute.New(server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.BasePath = server.URL + "/"
+	gceProjectName = stringValue("project")
+	gceZone = stringValue("zone")
+	return &stops
+}
+
+func TestScheduledStopWaitsForPreStopCheck(t *testing.T) {
+	stops := fakeGce(t, "RUNNING")
+	locationName = stringValue("UTC")
+	preStopProbeUrl = stringValue("")
+	preStopCommand = stringValue("exit 1")
+	preStopTimeout = durationValue(time.Second * 5)
+	preStopMaxWait = durationValue(0)
+
+	buildBoxesPool = []string{"box"}
+	boxSchedules = []boxSchedule{{box: "box", on: false, from: 0, to: time.Hour * 24}}
+	nodeInfoSnapshot.Lock()
+	nodeInfoSnapshot.m = map[string]JenkinsBuildBoxInfo{"box": {Idle: true}}
+	nodeInfoSnapshot.Unlock()
+	t.Cleanup(func() {
+		buildBoxesPool = nil
+		boxSchedules = nil
+		resetPreStopCheck("box")
+	})
+
+	applyBoxSchedules()
+
+	if n := atomic.LoadInt32(stops); n != 0 {
+		t.Errorf("box scheduled off was stopped %d times while its pre-stop check failed", n)
+	}
+	preStopFailingSince.Lock()
+	_, failing := preStopFailingSince.m["box"]
+	preStopFailingSince.Unlock()
+	if !failing {
+		t.Error("pre-stop check was not run before the scheduled stop")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultBootLeadTime = time.Second * 90
+
+// bootLeadTime is a moving average of the time taken by a box to go from
+// offline to connected to Jenkins.
+var bootLeadTime = struct {
+	sync.RWMutex
+	average time.Duration
+}{}
+
+// queuedJobNames are the jobs counted as demand in the last queue check.
+var queuedJobNames = struct {
+	sync.RWMutex
+	names []string
+}{}
+
+func setQueuedJobNames(names []string) {
+	queuedJobNames.Lock()
+	queuedJobNames.names = names
+	queuedJobNames.Unlock()
+}
+
+func recordBootLeadTime(duration time.Duration) {
+	bootLeadTime.Lock()
+	defer bootLeadTime.Unlock()
+
+	if bootLeadTime.average == 0 {
+		bootLeadTime.average = duration
+		return
+	}
+	bootLeadTime.average = (bootLeadTime.average*4 + duration) / 5
+}
+
+func estimatedBootLeadTime() time.Duration {
+	bootLeadTime.RLock()
+	defer bootLeadTime.RUnlock()
+
+	if bootLeadTime.average == 0 {
+		return defaultBootLeadTime
+	}
+	return bootLeadTime.average
+}
+
+// announceProvisioning sets the offline message of a box being started to
+// the jobs it is started for and when it should be ready. Jenkins shows it on
+// the node page and the queue items waiting for the node, which is the
+// closest to a per queue item comment the Jenkins API allows.
+func announceProvisioning(buildBox string) {
+	if !*announceProvisioningFlag || *powerOnly {
+		return
+	}
+	queuedJobNames.RLock()
+	jobs := queuedJobNames.names
+	queuedJobNames.RUnlock()
+	if len(jobs) == 0 {
+		return
+	}
+
+	more := ""
+	if len(jobs) > 3 {
+		more = fmt.Sprintf(" and %d more", len(jobs)-3)
+		jobs = jobs[:3]
+	}
+	message := fmt.Sprintf("%s: capacity is being provisioned for %s%s, ETA ~%ds",
+		offlineMarker, strings.Join(jobs, ", "), more, int(estimatedBootLeadTime().Seconds()))
+
+	resp, err := jenkinsRequest("toggle", "POST", jenkinsPath("computer", buildBox, "changeOfflineCause")+"?offlineMessage="+url.QueryEscape(message))
+	if err != nil {
+		log.Printf("Error announcing provisioning of %s: %s\n", buildBox, err.Error())
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+)
+
+// offlineMarker is the offline message set on the nodes the scaler toggles
+// offline, so they can be told apart from the ones taken offline by people.
+const offlineMarker = "Toggled offline by jenkins-nodes-auto-scaler"
+
+// recoverInterruptedToggles looks for nodes the scaler toggled offline whose
+// instance is still running, meaning a previous run died between toggling
+// them and starting or stopping their instance. Depending on the current
+// demand they are brought back online or stopped.
+func recoverInterruptedToggles() {
+	var interrupted []string
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, buildBox := range buildBoxesPool {
+		wg.Add(1)
+		go func(b string) {
+			defer recoverWorker()
+			defer wg.Done()
+			data := fetchNodeInfo(b)
+			if !data.TemporarilyOffline || !strings.HasPrefix(data.OfflineCauseReason, offlineMarker) {
+				return
+			}
+			if isCloudBoxRunning(b) {
+				mutex.Lock()
+				interrupted = append(interrupted, b)
+				mutex.Unlock()
+			}
+		}(buildBox)
+	}
+	wg.Wait()
+
+	if len(interrupted) == 0 {
+		return
+	}
+
+	queueSize := fetchQueueSize()
+	log.Printf("Found %d boxes left offline by a previous run with %d jobs in the queue\n", len(interrupted), queueSize)
+	for _, buildBox := range interrupted {
+		wg.Add(1)
+		go func(b string) {
+			defer recoverWorker()
+			defer wg.Done()
+			if queueSize > 0 {
+				log.Printf("Resuming start of %s\n", b)
+				enableNode(b)
+			} else if isNodeIdle(b) {
+				log.Printf("Resuming stop of %s\n", b)
+				disableNode(b)
+			}
+		}(buildBox)
+	}
+	wg.Wait()
+}
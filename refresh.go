@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshCommandTimeout bounds refreshCommand, so a hung command fails the
+// refresh instead of keeping a box out of rotation forever.
+const refreshCommandTimeout = time.Minute * 30
+
+// refreshStatus is the progress of a rolling refresh, as served by
+// /v1/refresh.
+type refreshStatus struct {
+	Running   bool      `json:"running"`
+	Pending   []string  `json:"pending"`
+	Current   string    `json:"current,omitempty"`
+	Phase     string    `json:"phase,omitempty"`
+	Done      []string  `json:"done"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"startedAt,omitempty"`
+}
+
+// refresh rolls through the boxes one at a time: the box is drained, stopped,
+// recreated by refreshCommand if set, then started and brought back online.
+var refresh = struct {
+	sync.Mutex
+	status refreshStatus
+}{}
+
+func isRefreshing(buildBox string) bool {
+	refresh.Lock()
+	defer refresh.Unlock()
+	return refresh.status.Running && refresh.status.Current == buildBox
+}
+
+func startRefresh(buildBoxes []string) error {
+	if observerBuild {
+		return errObserver
+	}
+	for _, buildBox := range buildBoxes {
+		if !inPool(buildBox) {
+			return fmt.Errorf("%s is not in the pool", buildBox)
+		}
+	}
+
+	refresh.Lock()
+	defer refresh.Unlock()
+	if refresh.status.Running {
+		return fmt.Errorf("a refresh is already running")
+	}
+	refresh.status = refreshStatus{
+		Running:   true,
+		Pending:   append([]string{}, buildBoxes...),
+		Done:      []string{},
+		StartedAt: time.Now(),
+	}
+	log.Printf("Refreshing %s\n", strings.Join(buildBoxes, ", "))
+	return nil
+}
+
+// progressRefresh moves the refresh on by one step. A box is only taken out
+// while it is offline or no job is waiting, so the refresh never takes away
+// capacity the queue needs.
+func progressRefresh(queueSize int) {
+	refresh.Lock()
+	status := refresh.status
+	refresh.Unlock()
+	if !status.Running {
+		return
+	}
+
+	switch status.Phase {
+	case "":
+		if len(status.Pending) == 0 {
+			log.Println("Refresh finished")
+			notify(eventRefresh, "", "Refresh finished for "+strings.Join(status.Done, ", "))
+			setRefresh(func(s *refreshStatus) { s.Running = false })
+			return
+		}
+		buildBox := status.Pending[0]
+		if queueSize > 0 && !isNodeOffline(buildBox) {
+			log.Printf("%d jobs waiting, holding the refresh of %s\n", queueSize, buildBox)
+			return
+		}
+		log.Printf("Draining %s for its refresh\n", buildBox)
+		setRefresh(func(s *refreshStatus) {
+			s.Pending = s.Pending[1:]
+			s.Current = buildBox
+			s.Phase = "draining"
+		})
+		if !isNodeOffline(buildBox) && !isNodeTemporarilyOffline(buildBox) {
+			toggleNodeStatus(buildBox, "offline")
+		}
+	case "draining":
+		buildBox := status.Current
+		if !isNodeIdle(buildBox) || !readyToStop(buildBox) {
+			return
+		}
+		setRefresh(func(s *refreshStatus) { s.Phase = "recreating" })
+		go recreateBox(buildBox)
+	}
+}
+
+// recreateBox stops, recreates and brings back a drained box in the
+// background, so a slow refresh command does not hold up the scaling. The
+// refresh moves on to the next box once the phase is reset.
+func recreateBox(buildBox string) {
+	defer recoverWorker()
+	defer func() {
+		if e := recover(); e != nil {
+			failRefresh(buildBox, fmt.Sprintf("Refresh of %s crashed: %v", buildBox, e))
+			panic(e)
+		}
+	}()
+	ensureCloudBoxIsNotRunning(buildBox)
+	if err := runRefreshCommand(buildBox); err != nil {
+		failRefresh(buildBox, fmt.Sprintf("Refresh command failed for %s: %s", buildBox, err.Error()))
+		return
+	}
+
+	setRefresh(func(s *refreshStatus) { s.Phase = "rejoining" })
+	if !enableNode(buildBox) {
+		failRefresh(buildBox, fmt.Sprintf("%s did not rejoin Jenkins after its refresh", buildBox))
+		return
+	}
+	log.Printf("%s refreshed\n", buildBox)
+	setRefresh(func(s *refreshStatus) {
+		s.Done = append(s.Done, buildBox)
+		s.Current = ""
+		s.Phase = ""
+	})
+}
+
+func setRefresh(update func(*refreshStatus)) {
+	refresh.Lock()
+	update(&refresh.status)
+	refresh.Unlock()
+}
+
+// failRefresh stops the refresh at the first box that fails, so a broken
+// image or template is not rolled through the whole pool.
+func failRefresh(buildBox string, message string) {
+	log.Println(message)
+	notifyKind(eventFailure, "refresh", buildBox, message)
+	setRefresh(func(s *refreshStatus) {
+		s.Running = false
+		s.Error = message
+	})
+}
+
+func runRefreshCommand(buildBox string) error {
+	if *refreshCommand == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), refreshCommandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", expandBoxPlaceholders(*refreshCommand, buildBox))
+	cmd.Env = append(os.Environ(), "BOX="+buildBox, "INSTANCE="+instanceName(buildBox), "ZONE="+instanceZone(buildBox))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runRefresh refreshes the boxes of refreshBoxes, or the whole pool, for the
+// refresh job. It is meant to run while the auto scaling is not.
+func runRefresh() {
+	buildBoxes := splitList(*refreshBoxes)
+	if len(buildBoxes) == 0 {
+		buildBoxes = buildBoxesPool
+	}
+	if err := startRefresh(buildBoxes); err != nil {
+		log.Printf("Error starting the refresh: %s\n", err.Error())
+		return
+	}
+
+	for {
+		refresh.Lock()
+		running := refresh.status.Running
+		refresh.Unlock()
+		if !running {
+			return
+		}
+
+		if queueSize := fetchQueueSize(); queueSize >= 0 {
+			snapshotNodeInfos(buildBoxesPool)
+			progressRefresh(queueSize)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func serveRefresh(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if !hasRole(r, roleOperate) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var buildBoxes []string
+		if boxes := r.URL.Query().Get("boxes"); boxes != "" {
+			buildBoxes = splitList(boxes)
+		} else {
+			buildBoxes = buildBoxesPool
+		}
+		if err := startRefresh(buildBoxes); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	refresh.Lock()
+	status := refresh.status
+	refresh.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "POST" {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// reservedBoxes are the boxes covered by reservations or committed use
+// discounts, which cost nothing more to keep running.
+var reservedBoxes = map[string]bool{}
+
+func loadReservedBoxes() {
+	for _, buildBox := range strings.Split(*reservedBoxesFlag, ",") {
+		if buildBox = strings.TrimSpace(buildBox); buildBox != "" {
+			reservedBoxes[buildBox] = true
+		}
+	}
+}
+
+// reservedFirst moves the reserved boxes ahead of the on-demand ones,
+// keeping the current order otherwise.
+func reservedFirst(buildBoxes []string) []string {
+	sorted := append([]string{}, buildBoxes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return reservedBoxes[sorted[i]] && !reservedBoxes[sorted[j]]
+	})
+	return sorted
+}
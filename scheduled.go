@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// isScheduled tells whether a queue item was caused by a timer trigger,
+// including the parameterized scheduler, rather than by someone or a push.
+func isScheduled(item JenkinsQueueItem) bool {
+	for _, action := range item.Actions {
+		for _, cause := range action.Causes {
+			if strings.Contains(cause.Class, "TimerTrigger") || strings.Contains(cause.Class, "parameterizedscheduler") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// capScheduledDemand limits the scheduled builds counted as demand to what
+// maxBoxesForScheduledBuilds boxes can run, unlimited when negative.
+func capScheduledDemand(scheduled int) int {
+	if *maxBoxesForScheduledBuilds < 0 {
+		return scheduled
+	}
+	limit := *maxBoxesForScheduledBuilds * *workersPerBuildBox
+	if scheduled > limit {
+		log.Printf("%d scheduled builds waiting, only counting %d of them\n", scheduled, limit)
+		return limit
+	}
+	return scheduled
+}
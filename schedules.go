@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// boxSchedule pins a box on or off every day between two times of day in
+// locationName, the window wrapping around midnight when from is after to.
+type boxSchedule struct {
+	box  string
+	on   bool
+	from time.Duration
+	to   time.Duration
+}
+
+var boxSchedules []boxSchedule
+
+// parseBoxSchedules parses comma separated rules in the form
+// box=on@HH:MM-HH:MM or box=off@HH:MM-HH:MM, e.g. "bench1=on@00:00-04:00".
+func parseBoxSchedules(value string) ([]boxSchedule, error) {
+	var schedules []boxSchedule
+	for _, rule := range splitList(value) {
+		invalid := fmt.Errorf("invalid box schedule %q", rule)
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, invalid
+		}
+		window := strings.SplitN(parts[1], "@", 2)
+		if len(window) != 2 || (window[0] != "on" && window[0] != "off") {
+			return nil, invalid
+		}
+		times := strings.SplitN(window[1], "-", 2)
+		if len(times) != 2 {
+			return nil, invalid
+		}
+		from, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, invalid
+		}
+		to, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, invalid
+		}
+		schedules = append(schedules, boxSchedule{box: parts[0], on: window[0] == "on", from: from, to: to})
+	}
+	return schedules, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// pinnedState returns "on" or "off" when a schedule pins the box at that
+// time, or an empty string when the box scales normally.
+func pinnedState(buildBox string, now time.Time) string {
+	if location, err := time.LoadLocation(*locationName); err == nil {
+		now = now.In(location)
+	}
+	timeOfDay := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+
+	for _, schedule := range boxSchedules {
+		if schedule.box != buildBox {
+			continue
+		}
+		inWindow := timeOfDay >= schedule.from && timeOfDay < schedule.to
+		if schedule.from > schedule.to {
+			inWindow = timeOfDay >= schedule.from || timeOfDay < schedule.to
+		}
+		if inWindow && schedule.on {
+			return "on"
+		} else if inWindow {
+			return "off"
+		}
+	}
+	return ""
+}
+
+func isPinnedOn(buildBox string) bool {
+	return pinnedState(buildBox, time.Now()) == "on"
+}
+
+func isPinnedOff(buildBox string) bool {
+	return pinnedState(buildBox, time.Now()) == "off"
+}
+
+// applyBoxSchedules starts the boxes pinned on that are offline, unless they
+// are out of rotation, and stops the boxes pinned off once they are idle.
+// The boxes are started concurrently, or only issued with asyncOperations.
+func applyBoxSchedules() {
+	if observerBuild {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, buildBox := range buildBoxesPool {
+		switch pinnedState(buildBox, time.Now()) {
+		case "on":
+			if outOfRotation(buildBox) || isPendingStart(buildBox) {
+				continue
+			}
+			if isNodeOffline(buildBox) || isNodeTemporarilyOffline(buildBox) {
+				log.Printf("%s is scheduled to be on, starting it\n", buildBox)
+				if *asyncOperations {
+					beginStart(buildBox)
+					continue
+				}
+				wg.Add(1)
+				go func(b string) {
+					defer recoverWorker()
+					defer wg.Done()
+					enableNode(b)
+				}(buildBox)
+			}
+		case "off":
+			if isCloudBoxRunning(buildBox) && isNodeIdle(buildBox) {
+				log.Printf("%s is scheduled to be off, stopping it\n", buildBox)
+				disableNode(buildBox)
+			}
+		}
+	}
+	wg.Wait()
+}
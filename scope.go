@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JenkinsView struct {
+	Jobs []struct {
+		Url string `json:"url"`
+	} `json:"jobs"`
+}
+
+// viewJobs are the jobs of jenkinsView, read by the history recording in
+// the background as well as by the queue checks.
+var viewJobs = struct {
+	sync.RWMutex
+	m       map[string]bool
+	fetched time.Time
+}{}
+
+// jobPathFromUrl turns a job or run url such as
+// https://ci/job/teams/job/api/job/app/12/ into its full name, teams/api/app.
+func jobPathFromUrl(jobUrl string) string {
+	u, err := url.Parse(jobUrl)
+	if err != nil {
+		return ""
+	}
+
+	var names []string
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i] == "job" {
+			name, err := url.PathUnescape(segments[i+1])
+			if err != nil {
+				name = segments[i+1]
+			}
+			names = append(names, name)
+			i++
+		}
+	}
+	return strings.Join(names, "/")
+}
+
+// inScope tells whether a queue item belongs to the jobs this scaler cares
+// about, as restricted by jobFilter and jenkinsView.
+func inScope(item JenkinsQueueItem) bool {
+	if *jobFilter == "" && *jenkinsView == "" {
+		return true
+	}
+
+	jobPath := jobPathFromUrl(item.Task.Url)
+	if *jobFilter != "" && !matchesJobFilter(jobPath) {
+		return false
+	}
+	if *jenkinsView != "" && !inView(jobPath) {
+		return false
+	}
+	return true
+}
+
+// matchesJobFilter matches a job against the comma separated patterns of
+// jobFilter, where a pattern is either a glob like "teams/api/*" or a folder
+// including all the jobs beneath it.
+func matchesJobFilter(jobPath string) bool {
+	for _, pattern := range strings.Split(*jobFilter, ",") {
+		pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+		if matched, _ := path.Match(pattern, jobPath); matched {
+			return true
+		}
+		if strings.HasPrefix(jobPath, pattern+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// inView tells whether a job is listed in jenkinsView, or is beneath a
+// folder or multibranch project listed in it.
+func inView(jobPath string) bool {
+	viewJobs.RLock()
+	defer viewJobs.RUnlock()
+	for jobPath != "" && jobPath != "." {
+		if viewJobs.m[jobPath] {
+			return true
+		}
+		jobPath = path.Dir(jobPath)
+	}
+	return false
+}
+
+// refreshViewJobs fetches the jobs of jenkinsView at most once a minute,
+// once per queue check. A failed fetch keeps the jobs fetched before, and
+// fails the queue check when none were, rather than leaving every queued
+// job out of scope.
+func refreshViewJobs() error {
+	viewJobs.RLock()
+	fetched, known := viewJobs.fetched, viewJobs.m != nil
+	viewJobs.RUnlock()
+	if *jenkinsView == "" || time.Since(fetched) <= time.Minute {
+		return nil
+	}
+
+	jobs, err := fetchViewJobs(*jenkinsView)
+	if err != nil {
+		if !known {
+			return err
+		}
+		log.Printf("Error fetching Jenkins view %s, keeping its jobs from %s: %s\n", *jenkinsView, fetched.Format("15:04"), err.Error())
+		return nil
+	}
+	viewJobs.Lock()
+	viewJobs.m = jobs
+	viewJobs.fetched = time.Now()
+	viewJobs.Unlock()
+	return nil
+}
+
+func fetchViewJobs(view string) (map[string]bool, error) {
+	resp, err := jenkinsRequest("view", "GET", jenkinsPath("view", view, "api", "json")+"?tree=jobs[url]")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("view API call answered with status %d", resp.StatusCode)
+	}
+
+	var data JenkinsView
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	jobs := map[string]bool{}
+	for _, job := range data.Jobs {
+		jobs[jobPathFromUrl(job.Url)] = true
+	}
+	return jobs, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestInViewIncludesJobsOfListedFolders(t *testing.T) {
+	viewJobs.m = map[string]bool{jobPathFromUrl("https://ci/job/teams/job/api/"): true, "release": true}
+	defer func() { viewJobs.m = nil }()
+
+	for jobPath, expected := range map[string]bool{
+		"teams/api":            true,
+		"teams/api/app":        true,
+		"teams/api/app/main":   true,
+		"release":              true,
+		"teams":                false,
+		"teams/web/app":        false,
+		"teams/api-legacy/app": false,
+		"releases/nightly":     false,
+	} {
+		if inView(jobPath) != expected {
+			t.Errorf("inView(%q) should be %t", jobPath, expected)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// slackNotifier posts events to a Slack incoming webhook.
+type slackNotifier struct {
+	webhookUrl string
+}
+
+func (s *slackNotifier) Notify(event scalingEvent) error {
+	return postJson(s.webhookUrl, struct {
+		Text string `json:"text"`
+	}{fmt.Sprintf("[%s] %s", event.Pool, event.Message)})
+}
+
+// pagerDutyNotifier triggers PagerDuty incidents through the Events API v2,
+// deduplicated per pool, box, event type and kind. A recovery resolves the
+// failure incident of its pool, box and kind.
+type pagerDutyNotifier struct {
+	routingKey string
+}
+
+func (p *pagerDutyNotifier) Notify(event scalingEvent) error {
+	type payload struct {
+		Summary   string `json:"summary"`
+		Source    string `json:"source"`
+		Severity  string `json:"severity"`
+		Component string `json:"component,omitempty"`
+		Group     string `json:"group"`
+	}
+	action, eventType := "trigger", event.Type
+	if event.Type == eventRecovery {
+		action, eventType = "resolve", eventFailure
+	}
+	return postJson("https://events.pagerduty.com/v2/enqueue", struct {
+		RoutingKey  string  `json:"routing_key"`
+		EventAction string  `json:"event_action"`
+		DedupKey    string  `json:"dedup_key"`
+		Payload     payload `json:"payload"`
+	}{
+		RoutingKey:  p.routingKey,
+		EventAction: action,
+		DedupKey:    event.Pool + "/" + event.Box + "/" + eventType + "/" + event.Kind,
+		Payload: payload{
+			Summary:   event.Message,
+			Source:    "jenkins-nodes-auto-scaler",
+			Severity:  "error",
+			Component: event.Box,
+			Group:     event.Pool,
+		},
+	})
+}
+
+// emailNotifier sends events by email, which suits the daily digest.
+type emailNotifier struct {
+	address string
+	from    string
+	to      []string
+}
+
+func (e *emailNotifier) Notify(event scalingEvent) error {
+	subject := fmt.Sprintf("[%s] %s", event.Pool, strings.Replace(event.Type, "_", " ", -1))
+	message := "From: " + e.from + "\r\n" +
+		"To: " + strings.Join(e.to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n\r\n" +
+		event.Message + "\r\n"
+	return smtp.SendMail(e.address, nil, e.from, e.to, []byte(message))
+}
+
+func postJson(url string, body interface{}) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := outboundClient.Post(url, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// demandSamples are the last demandWindow queue sizes, oldest first.
+var demandSamples []int
+
+// smoothDemand adds a queue size to the window and returns the
+// demandPercentile of the window, which is the sample itself when the window
+// holds a single sample. A high percentile holds on to demand, a low one
+// ignores queues that blip for a single poll.
+func smoothDemand(queueSize int) int {
+	demandSamples = append(demandSamples, queueSize)
+	if len(demandSamples) > *demandWindow {
+		demandSamples = demandSamples[len(demandSamples)-*demandWindow:]
+	}
+
+	sorted := append([]int{}, demandSamples...)
+	sort.Ints(sorted)
+	rank := int(math.Ceil(*demandPercentile/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// nodeInfoSnapshot holds the node info of the pool fetched at the top of an
+// iteration, shared by the start and stop paths. Entries are dropped as soon
+// as the scaler changes something on a box, so the next read fetches it again.
+var nodeInfoSnapshot = struct {
+	sync.RWMutex
+	m map[string]JenkinsBuildBoxInfo
+}{m: make(map[string]JenkinsBuildBoxInfo)}
+
+// snapshotNodeInfos fetches the info of all the boxes, at most
+// jenkinsConcurrency at a time, replacing the previous snapshot.
+func snapshotNodeInfos(buildBoxes []string) {
+	snapshotNodeInfosWithin(buildBoxes, 0)
+}
+
+// snapshotNodeInfosWithin is snapshotNodeInfos giving up on the requests
+// still running after timeout, unless it is 0. The boxes given up on get an
+// info marked unknown, which looks online and busy, and is skipped by the
+// usage accounting and when picking boxes to stop or keep online.
+func snapshotNodeInfosWithin(buildBoxes []string, timeout time.Duration) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	snapshot := make(map[string]JenkinsBuildBoxInfo, len(buildBoxes))
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, *jenkinsConcurrency)
+	for _, buildBox := range buildBoxes {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(b string) {
+			defer recoverWorker()
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			data, err := requestNodeInfoWithContext(ctx, b)
+			if err == nil || ctx.Err() != nil {
+				if err != nil {
+					log.Printf("Node info of %s not fetched in time, leaving it alone this iteration\n", b)
+					data = JenkinsBuildBoxInfo{Unknown: true}
+				}
+				mutex.Lock()
+				snapshot[b] = data
+				mutex.Unlock()
+			}
+		}(buildBox)
+	}
+	wg.Wait()
+
+	nodeInfoSnapshot.Lock()
+	nodeInfoSnapshot.m = snapshot
+	nodeInfoSnapshot.Unlock()
+}
+
+// fetchNodeInfo returns the node info from the snapshot, fetching and
+// caching it when missing.
+func fetchNodeInfo(buildBox string) JenkinsBuildBoxInfo {
+	nodeInfoSnapshot.RLock()
+	data, ok := nodeInfoSnapshot.m[buildBox]
+	nodeInfoSnapshot.RUnlock()
+	if ok {
+		return data
+	}
+
+	data, err := requestNodeInfo(buildBox)
+	if err == nil {
+		nodeInfoSnapshot.Lock()
+		nodeInfoSnapshot.m[buildBox] = data
+		nodeInfoSnapshot.Unlock()
+	}
+	return data
+}
+
+func isNodeInfoUnknown(buildBox string) bool {
+	return fetchNodeInfo(buildBox).Unknown
+}
+
+func invalidateNodeInfo(buildBox string) {
+	nodeInfoSnapshot.Lock()
+	delete(nodeInfoSnapshot.m, buildBox)
+	nodeInfoSnapshot.Unlock()
+}
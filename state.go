@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const stateSchemaVersion = 1
+const maxRecentActions = 50
+
+// The documents served by /v1/state. Fields are only ever added to this
+// schema; anything else requires bumping stateSchemaVersion.
+type stateDocument struct {
+	SchemaVersion int            `json:"schemaVersion"`
+	GeneratedAt   time.Time      `json:"generatedAt"`
+	Pools         []poolState    `json:"pools"`
+	RecentActions []scalingEvent `json:"recentActions"`
+}
+
+type poolState struct {
+	Name     string            `json:"name"`
+	Demand   demandState       `json:"demand"`
+	Boxes    []boxState        `json:"boxes"`
+	Override *capacityOverride `json:"override,omitempty"`
+}
+
+type demandState struct {
+	QueueSize     int       `json:"queueSize"`
+	BoxesNeeded   int       `json:"boxesNeeded"`
+	Unsatisfiable int       `json:"unsatisfiable"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+type boxState struct {
+	Name                   string     `json:"name"`
+	Instance               string     `json:"instance"`
+	InstanceStatus         string     `json:"instanceStatus"`
+	NodeOffline            bool       `json:"nodeOffline"`
+	NodeTemporarilyOffline bool       `json:"nodeTemporarilyOffline"`
+	NodeIdle               bool       `json:"nodeIdle"`
+	Executors              int        `json:"executors"`
+	StartedAt              *time.Time `json:"startedAt,omitempty"`
+	UptimeSeconds          int64      `json:"uptimeSeconds"`
+	UpdatedAt              time.Time  `json:"updatedAt"`
+}
+
+// observedState caches what the scaler last saw of each box while going
+// about its work, so serving the state does not call Jenkins or GCE.
+var observedState = struct {
+	sync.Mutex
+	demand        demandState
+	boxes         map[string]*boxState
+	recentActions []scalingEvent
+}{boxes: make(map[string]*boxState)}
+
+func observedBox(buildBox string) *boxState {
+	box, ok := observedState.boxes[buildBox]
+	if !ok {
+		box = &boxState{Name: buildBox, Instance: instanceName(buildBox)}
+		observedState.boxes[buildBox] = box
+	}
+	return box
+}
+
+func recordDemand(queueSize int) {
+	boxesNeeded := 0
+	if queueSize > 0 {
+		boxesNeeded = calculateNumberOfNodesToEnable(queueSize)
+	}
+
+	observedState.Lock()
+	observedState.demand = demandState{QueueSize: queueSize, BoxesNeeded: boxesNeeded, Unsatisfiable: unsatisfiableDemand, UpdatedAt: time.Now()}
+	observedState.Unlock()
+}
+
+func recordNodeInfo(buildBox string, data JenkinsBuildBoxInfo) {
+	observedState.Lock()
+	box := observedBox(buildBox)
+	box.NodeOffline = data.Offline
+	box.NodeTemporarilyOffline = data.TemporarilyOffline
+	box.NodeIdle = data.Idle
+	box.Executors = data.NumExecutors
+	box.UpdatedAt = time.Now()
+	observedState.Unlock()
+}
+
+func recordInstanceStatus(buildBox string, status string) {
+	observedState.Lock()
+	box := observedBox(buildBox)
+	previous := box.InstanceStatus
+	box.InstanceStatus = status
+	box.UpdatedAt = time.Now()
+	observedState.Unlock()
+
+	if previous != "" && previous != status {
+		notify(eventTransition, buildBox, fmt.Sprintf("Instance of %s went from %s to %s", buildBox, previous, status))
+	}
+}
+
+func recordAction(event scalingEvent) {
+	observedState.Lock()
+	observedState.recentActions = append(observedState.recentActions, event)
+	if len(observedState.recentActions) > maxRecentActions {
+		observedState.recentActions = observedState.recentActions[len(observedState.recentActions)-maxRecentActions:]
+	}
+	observedState.Unlock()
+}
+
+func currentState() stateDocument {
+	// The uptimes are read first, as recordUsage takes the usage lock
+	// before the observed state one.
+	uptimes := make(map[string]time.Duration, len(buildBoxesPool))
+	for _, buildBox := range buildBoxesPool {
+		uptimes[buildBox] = uptime(buildBox)
+	}
+
+	observedState.Lock()
+	defer observedState.Unlock()
+
+	pool := poolState{Name: *poolName, Demand: observedState.demand, Boxes: []boxState{}}
+	override.Lock()
+	if o := override.current; o != nil && time.Now().Before(o.Until) {
+		pool.Override = o
+	}
+	override.Unlock()
+	for _, buildBox := range buildBoxesPool {
+		box := *observedBox(buildBox)
+		lastStarted.RLock()
+		started := lastStarted.m[buildBox]
+		lastStarted.RUnlock()
+		if !started.IsZero() {
+			box.StartedAt = &started
+		}
+		box.UptimeSeconds = int64(uptimes[buildBox].Seconds())
+		pool.Boxes = append(pool.Boxes, box)
+	}
+	sort.Slice(pool.Boxes, func(i, j int) bool {
+		return pool.Boxes[i].Name < pool.Boxes[j].Name
+	})
+
+	return stateDocument{
+		SchemaVersion: stateSchemaVersion,
+		GeneratedAt:   time.Now(),
+		Pools:         []poolState{pool},
+		RecentActions: append([]scalingEvent{}, observedState.recentActions...),
+	}
+}
+
+func serveState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentState())
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// dailySummary is what the pool did over the previous day, including the
+// box hours saved by keeping boxes stopped.
+type dailySummary struct {
+	Day        string
+	Pool       string
+	Started    int
+	Stopped    int
+	Failures   int
+	BusyHours  float64
+	IdleHours  float64
+	SavedHours float64
+}
+
+func (s dailySummary) String() string {
+	return fmt.Sprintf("Daily summary for pool %s: %d boxes started, %d boxes stopped, %d failures, %.1f busy and %.1f idle box hours, %.1f box hours saved",
+		s.Pool, s.Started, s.Stopped, s.Failures, s.BusyHours, s.IdleHours, s.SavedHours)
+}
+
+var summaries = struct {
+	sync.Mutex
+	since     time.Time
+	busyHours float64
+	idleHours float64
+	last      *dailySummary
+}{}
+
+// usageHours returns the busy and idle hours of the whole pool so far.
+func usageHours() (float64, float64) {
+	usage.Lock()
+	defer usage.Unlock()
+
+	var busy, idle float64
+	for _, box := range usage.boxes {
+		busy += box.BusySeconds / time.Hour.Seconds()
+		idle += box.IdleSeconds / time.Hour.Seconds()
+	}
+	return busy, idle
+}
+
+// startDailySummary marks the point the first summary is measured from.
+func startDailySummary(now time.Time) {
+	busy, idle := usageHours()
+
+	summaries.Lock()
+	summaries.since = now
+	summaries.busyHours = busy
+	summaries.idleHours = idle
+	summaries.Unlock()
+}
+
+// summarizeDay turns the event counts and the usage since the previous
+// summary into the summary of the day that just ended.
+func summarizeDay(now time.Time, counts map[string]int) dailySummary {
+	busy, idle := usageHours()
+
+	summaries.Lock()
+	defer summaries.Unlock()
+
+	summary := dailySummary{
+		Day:       now.AddDate(0, 0, -1).Format("2006-01-02"),
+		Pool:      *poolName,
+		Started:   counts[eventScaleUp],
+		Stopped:   counts[eventScaleDown],
+		Failures:  counts[eventFailure],
+		BusyHours: busy - summaries.busyHours,
+		IdleHours: idle - summaries.idleHours,
+	}
+	summary.SavedHours = float64(len(buildBoxesPool))*now.Sub(summaries.since).Hours() - summary.BusyHours - summary.IdleHours
+	if summary.SavedHours < 0 {
+		summary.SavedHours = 0
+	}
+
+	summaries.since = now
+	summaries.busyHours = busy
+	summaries.idleHours = idle
+	summaries.last = &summary
+	return summary
+}
+
+// publishSummaryToJenkins sets the summary as the description of the last
+// build of summaryJenkinsJob and of the summaryJenkinsView view, for the
+// teams that only look at Jenkins.
+func publishSummaryToJenkins(summary dailySummary) {
+	description := url.QueryEscape(fmt.Sprintf("%s (%s)", summary.String(), summary.Day))
+	if *summaryJenkinsJob != "" {
+		submitDescription(jenkinsJobPath(*summaryJenkinsJob, "lastBuild", "submitDescription") + "?description=" + description)
+	}
+	if *summaryJenkinsView != "" {
+		submitDescription(jenkinsPath("view", *summaryJenkinsView, "submitDescription") + "?description=" + description)
+	}
+}
+
+func submitDescription(path string) {
+	resp, err := jenkinsRequest("description", "POST", path)
+	if err != nil {
+		log.Printf("Error publishing the daily summary to Jenkins: %s\n", err.Error())
+		return
+	}
+	resp.Body.Close()
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Pool}} scaling status</title></head>
+<body>
+<h1>Pool {{.Pool}}</h1>
+{{with .Override}}
+<p><strong>Override: at least {{.Boxes}} boxes online until {{.Until.Format "2006-01-02 15:04 MST"}}{{with .Reason}} ({{.}}){{end}}</strong></p>
+{{end}}
+{{with .Last}}
+<h2>{{.Day}}</h2>
+<table>
+<tr><td>Boxes started</td><td>{{.Started}}</td></tr>
+<tr><td>Boxes stopped</td><td>{{.Stopped}}</td></tr>
+<tr><td>Failures</td><td>{{.Failures}}</td></tr>
+<tr><td>Busy box hours</td><td>{{printf "%.1f" .BusyHours}}</td></tr>
+<tr><td>Idle box hours</td><td>{{printf "%.1f" .IdleHours}}</td></tr>
+<tr><td>Box hours saved</td><td>{{printf "%.1f" .SavedHours}}</td></tr>
+</table>
+{{else}}
+<p>No daily summary yet, the first one is made at midnight.</p>
+{{end}}
+<p>Current state: <a href="v1/state">v1/state</a></p>
+</body>
+</html>
+`))
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	summaries.Lock()
+	last := summaries.last
+	summaries.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	statusPage.Execute(w, struct {
+		Pool     string
+		Last     *dailySummary
+		Override *capacityOverride
+	}{*poolName, last, activeOverride()})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const minRestartDelay = time.Second * 10
+const maxRestartDelay = time.Minute * 10
+
+// A loop running longer than this is considered healthy again, and its
+// crash count starts over.
+const healthyRunDuration = time.Hour
+
+// supervise runs the loop, restarting it with an increasing delay every time
+// it panics, until it has crashed maxCrashes times in a row.
+func supervise(loop func()) {
+	crashes := 0
+	delay := minRestartDelay
+	for {
+		started := time.Now()
+		e := runRecovering(loop)
+		if e == nil {
+			return
+		}
+
+		if time.Since(started) > healthyRunDuration {
+			crashes = 0
+			delay = minRestartDelay
+		}
+		crashes = crashes + 1
+		if crashes >= *maxCrashes {
+			notifyKind(eventFailure, "loop_crash", "", fmt.Sprintf("Control loop crashed %d times in a row, giving up: %v", crashes, e))
+			panic(e)
+		}
+
+		log.Printf("\n\033[31;1m%s\x1b[0m\n", e)
+		log.Printf("Control loop crashed (%d/%d), restarting in %s\n", crashes, *maxCrashes, delay)
+		notifyKind(eventFailure, "loop_crash", "", fmt.Sprintf("Control loop crashed, restarting in %s: %v", delay, e))
+		time.Sleep(delay)
+
+		delay = delay * 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+func runRecovering(loop func()) (recovered interface{}) {
+	defer func() {
+		recovered = recover()
+	}()
+	loop()
+	return nil
+}
+
+// workerPanic holds the first panic recovered from a goroutine of the loop,
+// e.g. one fetching node info or starting a box, so it can be raised from
+// the control loop where supervise recovers it.
+var workerPanic = struct {
+	sync.Mutex
+	e interface{}
+}{}
+
+// recoverWorker is deferred first by every goroutine calling Jenkins or
+// GCE, so a panic in it does not take the whole process down.
+func recoverWorker() {
+	e := recover()
+	if e == nil {
+		return
+	}
+	log.Printf("\n\033[31;1m%s\x1b[0m\n", e)
+	workerPanic.Lock()
+	if workerPanic.e == nil {
+		workerPanic.e = e
+	}
+	workerPanic.Unlock()
+}
+
+// checkWorkers panics with the panic recovered from a goroutine since the
+// last check, if any.
+func checkWorkers() {
+	workerPanic.Lock()
+	e := workerPanic.e
+	workerPanic.e = nil
+	workerPanic.Unlock()
+	if e != nil {
+		panic(e)
+	}
+}
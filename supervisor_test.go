@@ -0,0 +1,27 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestWorkerPanicIsRaisedFromTheLoop(t *testing.T) {
+	loop := func() {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer recoverWorker()
+			defer wg.Done()
+			panic("malformed API response")
+		}()
+		wg.Wait()
+		checkWorkers()
+	}
+
+	if e := runRecovering(loop); e != "malformed API response" {
+		t.Errorf("loop recovered %v instead of the worker panic", e)
+	}
+	if e := runRecovering(checkWorkers); e != nil {
+		t.Errorf("worker panic was raised twice: %v", e)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type throttleState struct {
+	event      scalingEvent
+	lastSent   time.Time
+	suppressed int
+}
+
+// notificationThrottle tracks, per event type and box, when an event was
+// last sent and how many have been held back since, plus the last event of
+// each box to spot identical consecutive ones.
+var notificationThrottle = struct {
+	sync.Mutex
+	states    map[string]*throttleState
+	lastByBox map[string]string
+}{states: make(map[string]*throttleState), lastByBox: make(map[string]string)}
+
+// throttleNotification decides whether the event should be sent, returning
+// the summaries of suppressed bursts that just ended along with it.
+func throttleNotification(event scalingEvent) (bool, []scalingEvent) {
+	if event.Type == eventDigest {
+		return true, nil
+	}
+
+	key := event.Type + "/" + event.Box
+	signature := event.Type + "/" + event.Message
+
+	notificationThrottle.Lock()
+	defer notificationThrottle.Unlock()
+
+	var summaries []scalingEvent
+	previous := notificationThrottle.lastByBox[event.Box]
+	notificationThrottle.lastByBox[event.Box] = signature
+	if previous != signature {
+		for k, state := range notificationThrottle.states {
+			if state.event.Box == event.Box && k != key && state.suppressed > 0 {
+				summaries = append(summaries, suppressedSummary(state))
+				state.suppressed = 0
+			}
+		}
+	}
+
+	state := notificationThrottle.states[key]
+	if state == nil {
+		state = &throttleState{}
+		notificationThrottle.states[key] = state
+	}
+
+	duplicate := *deduplicateNotifications && previous == signature && !state.lastSent.IsZero()
+	limited := *notificationInterval > 0 && event.Time.Sub(state.lastSent) < *notificationInterval
+	if duplicate || limited {
+		state.suppressed += 1
+		return false, summaries
+	}
+
+	if state.suppressed > 0 {
+		summaries = append(summaries, suppressedSummary(state))
+		state.suppressed = 0
+	}
+	state.event = event
+	state.lastSent = event.Time
+	return true, summaries
+}
+
+// flushSuppressedNotifications sends, at most once per notificationInterval,
+// a summary of the events suppressed by the rate limit.
+func flushSuppressedNotifications(now time.Time) {
+	if *notificationInterval <= 0 {
+		return
+	}
+
+	var summaries []scalingEvent
+	notificationThrottle.Lock()
+	for _, state := range notificationThrottle.states {
+		if state.suppressed > 0 && now.Sub(state.lastSent) >= *notificationInterval {
+			summaries = append(summaries, suppressedSummary(state))
+			state.suppressed = 0
+			state.lastSent = now
+		}
+	}
+	notificationThrottle.Unlock()
+
+	for _, summary := range summaries {
+		dispatch(summary)
+	}
+}
+
+func suppressedSummary(state *throttleState) scalingEvent {
+	summary := state.event
+	summary.Message = fmt.Sprintf("%s (%d similar notifications suppressed since %s)",
+		state.event.Message, state.suppressed, state.lastSent.Format("15:04"))
+	summary.Time = time.Now()
+	return summary
+}
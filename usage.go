@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var boxIdleSeconds = expvar.NewMap("box_idle_seconds")
+var boxBusySeconds = expvar.NewMap("box_busy_seconds")
+var wastedInstanceHours = expvar.NewMap("wasted_instance_hours")
+
+// boxUsage is the time a box has spent powered on, split between idle and
+// running builds. Idle time is what the pool wastes.
+type boxUsage struct {
+	IdleSeconds float64 `json:"idleSeconds"`
+	BusySeconds float64 `json:"busySeconds"`
+}
+
+// persistedState is what the scaler keeps across restarts in stateFile.
+type persistedState struct {
+	Usage           map[string]*boxUsage `json:"usage"`
+	LastKnownGood   *lastKnownGood       `json:"lastKnownGood,omitempty"`
+	PoolSwitch      *switchState         `json:"poolSwitch,omitempty"`
+	Override        *capacityOverride    `json:"override,omitempty"`
+	RaisedExecutors map[string]int       `json:"raisedExecutors,omitempty"`
+}
+
+var usage = struct {
+	sync.Mutex
+	boxes     map[string]*boxUsage
+	lastCheck time.Time
+	lastSave  time.Time
+}{boxes: make(map[string]*boxUsage)}
+
+// recordUsage adds the time elapsed since the previous iteration to the idle
+// or busy time of every powered on box, according to the node snapshot.
+func recordUsage(now time.Time) {
+	usage.Lock()
+	defer usage.Unlock()
+
+	elapsed := now.Sub(usage.lastCheck).Seconds()
+	usage.lastCheck = now
+	if elapsed <= 0 || elapsed > time.Hour.Seconds() {
+		return
+	}
+
+	for _, buildBox := range buildBoxesPool {
+		nodeInfoSnapshot.RLock()
+		data, ok := nodeInfoSnapshot.m[buildBox]
+		nodeInfoSnapshot.RUnlock()
+		if !ok || data.Unknown || !isPoweredOn(buildBox, data) {
+			continue
+		}
+
+		box := usage.boxes[buildBox]
+		if box == nil {
+			box = &boxUsage{}
+			usage.boxes[buildBox] = box
+		}
+		if data.Idle {
+			box.IdleSeconds += elapsed
+		} else {
+			box.BusySeconds += elapsed
+		}
+		publishUsage(buildBox, box)
+	}
+
+	if *stateFile != "" && now.Sub(usage.lastSave) > time.Minute {
+		usage.lastSave = now
+		if err := saveState(); err != nil {
+			log.Printf("Error saving state to %s: %s\n", *stateFile, err.Error())
+		}
+	}
+}
+
+func isPoweredOn(buildBox string, data JenkinsBuildBoxInfo) bool {
+	observedState.Lock()
+	status := observedBox(buildBox).InstanceStatus
+	observedState.Unlock()
+
+	return status == "RUNNING" || !data.Offline
+}
+
+func publishUsage(buildBox string, box *boxUsage) {
+	idle := new(expvar.Float)
+	idle.Set(box.IdleSeconds)
+	boxIdleSeconds.Set(buildBox, idle)
+
+	busy := new(expvar.Float)
+	busy.Set(box.BusySeconds)
+	boxBusySeconds.Set(buildBox, busy)
+
+	wasted := new(expvar.Float)
+	wasted.Set(box.IdleSeconds / time.Hour.Seconds())
+	wastedInstanceHours.Set(buildBox, wasted)
+}
+
+// saveStateNow saves the state outside of the periodic saves of
+// recordUsage, for changes that must survive a restart.
+func saveStateNow() {
+	if *stateFile == "" {
+		return
+	}
+	usage.Lock()
+	defer usage.Unlock()
+
+	usage.lastSave = time.Now()
+	if err := saveState(); err != nil {
+		log.Printf("Error saving state to %s: %s\n", *stateFile, err.Error())
+	}
+}
+
+// saveState writes the persisted state to a temporary file first, so a crash
+// never leaves a truncated state file behind. Callers hold the usage lock.
+func saveState() error {
+	outage.Lock()
+	known := outage.lastKnownGood
+	outage.Unlock()
+
+	poolSwitch.Lock()
+	switched := poolSwitch.state
+	poolSwitch.Unlock()
+
+	override.Lock()
+	forced := override.current
+	override.Unlock()
+
+	raisedExecutors.Lock()
+	raised := make(map[string]int, len(raisedExecutors.m))
+	for buildBox, executors := range raisedExecutors.m {
+		raised[buildBox] = executors
+	}
+	raisedExecutors.Unlock()
+
+	content, err := json.MarshalIndent(persistedState{Usage: usage.boxes, LastKnownGood: known, PoolSwitch: &switched, Override: forced, RaisedExecutors: raised}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(*stateFile+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(*stateFile+".tmp", *stateFile)
+}
+
+func loadState() error {
+	if *stateFile == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(*stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return err
+	}
+
+	outage.Lock()
+	outage.lastKnownGood = state.LastKnownGood
+	outage.Unlock()
+	if state.Override != nil {
+		publishOverride(state.Override)
+	}
+	raisedExecutors.Lock()
+	for buildBox, executors := range state.RaisedExecutors {
+		raisedExecutors.m[buildBox] = executors
+	}
+	raisedExecutors.Unlock()
+	if state.PoolSwitch != nil {
+		poolSwitch.Lock()
+		poolSwitch.state = *state.PoolSwitch
+		poolSwitch.Unlock()
+	}
+
+	usage.Lock()
+	defer usage.Unlock()
+	for buildBox, box := range state.Usage {
+		usage.boxes[buildBox] = box
+		publishUsage(buildBox, box)
+	}
+	return nil
+}
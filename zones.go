@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// instanceZones maps instance names to the zone they were found in when
+// looking up the project's instances at startup.
+var instanceZones = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// instanceZone returns the zone of the instance of a box, defaulting to
+// gceZone for instances that were not found.
+func instanceZone(buildBox string) string {
+	return zoneOfInstance(instanceName(buildBox))
+}
+
+func zoneOfInstance(instance string) string {
+	instanceZones.RLock()
+	defer instanceZones.RUnlock()
+
+	if zone, ok := instanceZones.m[instance]; ok {
+		return zone
+	}
+	return *gceZone
+}
+
+// ambiguousInstances are the instance names found in more than one zone,
+// with the zones they were found in.
+var ambiguousInstances = map[string][]string{}
+
+// lookupInstances lists the instances of every zone of the project, caching
+// their zones and passing each of them to found.
+func lookupInstances(found func(*compute.Instance)) error {
+	zones := map[string]string{}
+	err := service.Instances.AggregatedList(*gceProjectName).Pages(context.TODO(), func(list *compute.InstanceAggregatedList) error {
+		for _, scoped := range list.Items {
+			for _, i := range scoped.Instances {
+				zone := path.Base(i.Zone)
+				if previous, ok := zones[i.Name]; ok && previous != zone {
+					if len(ambiguousInstances[i.Name]) == 0 {
+						ambiguousInstances[i.Name] = []string{previous}
+					}
+					ambiguousInstances[i.Name] = append(ambiguousInstances[i.Name], zone)
+				}
+				zones[i.Name] = zone
+				found(i)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	instanceZones.Lock()
+	instanceZones.m = zones
+	instanceZones.Unlock()
+	return nil
+}
+
+// checkInstanceZones refuses instances existing with the same name in more
+// than one zone, as there is no telling which one is meant.
+func checkInstanceZones(instances []string) error {
+	for _, instance := range instances {
+		if zones, ok := ambiguousInstances[instance]; ok {
+			return fmt.Errorf("instance %s exists in zones %s, it should be unique in the project", instance, strings.Join(zones, ", "))
+		}
+	}
+	return nil
+}